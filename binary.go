@@ -0,0 +1,296 @@
+package boo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// The binary model format starts with binaryMagic and the format version, as
+// a little-endian uint32. Then come the metadata, as a length-prefixed JSON document
+// (the version 2 JSON format without the trees), the number of rounds, and, for each round,
+// the number of trees followed by the trees. Each tree is stored as the number of nodes
+// and the number of outputs of its leaves (0 except for vector-leaf trees), followed by the arrays
+// of split features (-1 for leaves), thresholds, gains, sample counts and values of the nodes, in
+// preorder, and, for vector-leaf trees, the value vectors of the leaves, in the same order. All the numbers are little-endian,
+// and the file ends with the CRC32 (IEEE) checksum of everything before it.
+const (
+	binaryMagic   = "BOO\x00"
+	binaryVersion = 1
+	binaryMaxLen  = 1 << 30 //sanity limit for the lengths read
+	binaryChunk   = 1 << 16 //the most elements allocated at once while reading
+)
+
+// Writes the ensemble M to w in boo's compact binary format.
+func WriteBinary(M *MultiClass, w io.Writer) error {
+	crc := crc32.NewIEEE()
+	mw := io.MultiWriter(w, crc)
+	meta, err := json.Marshal(M.jsonMetaData())
+	if err != nil {
+		return err
+	}
+	le := binary.LittleEndian
+	header := append([]byte(binaryMagic), 0, 0, 0, 0)
+	le.PutUint32(header[len(binaryMagic):], binaryVersion)
+	if _, err = mw.Write(header); err != nil {
+		return err
+	}
+	if err = writeBinaryBytes(mw, meta); err != nil {
+		return err
+	}
+	if err = binary.Write(mw, le, uint32(len(M.b))); err != nil {
+		return err
+	}
+	for _, round := range M.b {
+		if err = binary.Write(mw, le, uint32(len(round))); err != nil {
+			return err
+		}
+		for _, t := range round {
+			if err = writeBinaryTree(mw, t); err != nil {
+				return err
+			}
+		}
+	}
+	return binary.Write(w, le, crc.Sum32())
+}
+
+func writeBinaryBytes(w io.Writer, b []byte) error {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(b))); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// The arrays for one tree in the binary format.
+type binaryTree struct {
+	feature   []int32
+	threshold []float64
+	gain      []float64
+	samples   []int32
+	value     []float64
+	values    []float64
+}
+
+func (b *binaryTree) add(T *Tree, outputs int) {
+	f := int32(-1)
+	if !T.Leaf() {
+		f = int32(T.splitFeatureIndex)
+	}
+	b.feature = append(b.feature, f)
+	b.threshold = append(b.threshold, T.threshold)
+	b.gain = append(b.gain, T.bestScoreSoFar)
+	b.samples = append(b.samples, int32(T.nsamples))
+	b.value = append(b.value, T.value)
+	if T.Leaf() {
+		if outputs > 0 {
+			v := make([]float64, outputs)
+			copy(v, T.values)
+			b.values = append(b.values, v...)
+		}
+		return
+	}
+	b.add(T.left, outputs)
+	b.add(T.right, outputs)
+}
+
+func writeBinaryTree(w io.Writer, T *Tree) error {
+	b := &binaryTree{}
+	outputs := T.outputs()
+	b.add(T, outputs)
+	for _, v := range []any{uint32(len(b.feature)), uint32(outputs), b.feature, b.threshold, b.gain, b.samples, b.value, b.values} {
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads an ensemble in boo's binary format from r. The reader is consumed up to the
+// end of the model.
+func ReadBinary(r io.Reader) (*MultiClass, error) {
+	crc := crc32.NewIEEE()
+	tr := io.TeeReader(r, crc)
+	le := binary.LittleEndian
+	header := make([]byte, len(binaryMagic)+4)
+	if _, err := io.ReadFull(tr, header); err != nil {
+		return nil, fmt.Errorf("Error reading header: %v", err)
+	}
+	if string(header[:len(binaryMagic)]) != binaryMagic {
+		return nil, fmt.Errorf("Not a boo binary model")
+	}
+	if v := le.Uint32(header[len(binaryMagic):]); v != binaryVersion {
+		return nil, fmt.Errorf("Unsupported binary model version: %d", v)
+	}
+	meta, err := readBinaryBytes(tr)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading metadata: %v", err)
+	}
+	j := &JSONModel{}
+	if err = json.Unmarshal(meta, j); err != nil {
+		return nil, fmt.Errorf("Error unmarshalling metadata: %v", err)
+	}
+	ret, err := j.metaData()
+	if err != nil {
+		return nil, err
+	}
+	nrounds, err := readBinaryLen(tr)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the number of rounds: %v", err)
+	}
+	//The slices grow as the trees are read, so a corrupted length can't cause
+	//a large allocation.
+	ret.b = make([][]*Tree, 0, min(nrounds, binaryChunk))
+	for i := 0; i < nrounds; i++ {
+		ntrees, err := readBinaryLen(tr)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading round %d: %v", i, err)
+		}
+		round := make([]*Tree, 0, min(ntrees, binaryChunk))
+		for k := 0; k < ntrees; k++ {
+			t, err := readBinaryTree(tr, ret.xgb)
+			if err != nil {
+				return nil, fmt.Errorf("Error reading tree for round %d, class %d: %v", i, k, err)
+			}
+			round = append(round, t)
+		}
+		ret.b = append(ret.b, round)
+	}
+	sum := crc.Sum32()
+	var stored uint32
+	if err = binary.Read(r, le, &stored); err != nil {
+		return nil, fmt.Errorf("Error reading checksum: %v", err)
+	}
+	if stored != sum {
+		return nil, fmt.Errorf("Checksum mismatch, the model is corrupted")
+	}
+	return ret, nil
+}
+
+func readBinaryLen(r io.Reader) (int, error) {
+	var n uint32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return 0, err
+	}
+	if n > binaryMaxLen {
+		return 0, fmt.Errorf("Invalid length %d", n)
+	}
+	return int(n), nil
+}
+
+func readBinaryBytes(r io.Reader) ([]byte, error) {
+	n, err := readBinaryLen(r)
+	if err != nil {
+		return nil, err
+	}
+	return readBinarySlice[byte](r, n)
+}
+
+// Reads n little-endian numbers from r. They are read in chunks, so the memory allocated
+// is bounded by the data actually in r, even if n is wrong.
+func readBinarySlice[T byte | int32 | float64](r io.Reader, n int) ([]T, error) {
+	ret := make([]T, 0, min(n, binaryChunk))
+	for len(ret) < n {
+		chunk := make([]T, min(n-len(ret), binaryChunk))
+		if err := binary.Read(r, binary.LittleEndian, chunk); err != nil {
+			return nil, err
+		}
+		ret = append(ret, chunk...)
+	}
+	return ret, nil
+}
+
+func readBinaryTree(r io.Reader, xgb bool) (*Tree, error) {
+	n, err := readBinaryLen(r)
+	if err != nil {
+		return nil, err
+	}
+	outputs, err := readBinaryLen(r)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 || n*max(outputs, 1) > binaryMaxLen {
+		return nil, fmt.Errorf("Invalid tree size %d (%d outputs)", n, outputs)
+	}
+	b := &binaryTree{}
+	if b.feature, err = readBinarySlice[int32](r, n); err != nil {
+		return nil, err
+	}
+	for _, v := range []*[]float64{&b.threshold, &b.gain} {
+		if *v, err = readBinarySlice[float64](r, n); err != nil {
+			return nil, err
+		}
+	}
+	if b.samples, err = readBinarySlice[int32](r, n); err != nil {
+		return nil, err
+	}
+	if b.value, err = readBinarySlice[float64](r, n); err != nil {
+		return nil, err
+	}
+	nleaves := 0
+	for _, f := range b.feature {
+		if f < 0 {
+			nleaves++
+		}
+	}
+	if b.values, err = readBinarySlice[float64](r, nleaves*outputs); err != nil {
+		return nil, err
+	}
+	node, leaf := 0, 0
+	var build func() (*Tree, error)
+	build = func() (*Tree, error) {
+		if node >= n {
+			return nil, errors.New("Inconsistent tree arrays")
+		}
+		i := node
+		node++
+		ret := &Tree{xgb: xgb, branches: 1, threshold: b.threshold[i], bestScoreSoFar: b.gain[i], nsamples: int(b.samples[i]), value: b.value[i]}
+		if b.feature[i] < 0 {
+			if outputs > 0 {
+				ret.values = b.values[leaf*outputs : (leaf+1)*outputs]
+				ret.outs = outputs
+			}
+			leaf++
+			return ret, nil
+		}
+		ret.splitFeatureIndex = int(b.feature[i])
+		var err error
+		if ret.left, err = build(); err != nil {
+			return nil, err
+		}
+		if ret.right, err = build(); err != nil {
+			return nil, err
+		}
+		ret.branches += ret.left.branches + ret.right.branches
+		ret.outs = outputs
+		return ret, nil
+	}
+	ret, err := build()
+	if err == nil && node != n {
+		err = errors.New("Inconsistent tree arrays")
+	}
+	return ret, err
+}
+
+// Implements encoding.BinaryMarshaler, using the format of WriteBinary.
+func (M *MultiClass) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := WriteBinary(M, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Implements encoding.BinaryUnmarshaler, using the format of WriteBinary.
+func (M *MultiClass) UnmarshalBinary(data []byte) error {
+	ret, err := ReadBinary(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	*M = *ret
+	return nil
+}
@@ -0,0 +1,91 @@
+package boo
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/rmera/boo/utils"
+	"gonum.org/v1/gonum/mat"
+)
+
+// Returns a calibrated copy of the ensemble, where the probabilities for each class are
+// mapped through a Platt scaling (method "platt") or isotonic regression (method "isotonic")
+// fitted on the data in D, which should not have been used for training. For multi-class
+// ensembles the calibrated probabilities are normalized to add up to 1. For multi-label
+// (sigmoid) ensembles, the LabelSets of D are used as targets. M itself is not modified.
+func (M *MultiClass) Calibrate(D *utils.DataBunch, method string) (*MultiClass, error) {
+	if len(D.Data) == 0 {
+		return nil, fmt.Errorf("No data to fit the calibration")
+	}
+	uncal := *M
+	uncal.calibration = nil
+	probs := mat.NewDense(len(D.Data), len(M.classLabels), nil)
+	for i, v := range D.Data {
+		probs.SetRow(i, uncal.PredictSingle(v))
+	}
+	cal, err := utils.FitCalibration(method, probs, M.calibrationTargets(D), M.probTransformName != "sigmoid")
+	if err != nil {
+		return nil, err
+	}
+	uncal.calibration = cal
+	return &uncal, nil
+}
+
+// Returns true if the ensemble's probabilities are calibrated.
+func (M *MultiClass) IsCalibrated() bool {
+	return M.calibration != nil
+}
+
+// Returns a matrix with one row per sample in D and one column per class, where each element i,j
+// is 1 if the sample i belongs to the class j, and 0 otherwise.
+func (M *MultiClass) calibrationTargets(D *utils.DataBunch) *mat.Dense {
+	ret := mat.NewDense(len(D.Data), len(M.classLabels), nil)
+	multilabel := M.probTransformName == "sigmoid" && len(D.LabelSets) == len(D.Data)
+	for i := range D.Data {
+		for j, l := range M.classLabels {
+			if (multilabel && slices.Contains(D.LabelSets[i], l)) || (!multilabel && D.Labels[i] == l) {
+				ret.Set(i, j, 1)
+			}
+		}
+	}
+	return ret
+}
+
+// Returns the reliability curve of the ensemble's probabilities for the class with the
+// given index, on the data D, with the given number of bins of equal width. For each bin,
+// it returns the mean predicted probability, the fraction of samples that actually belong to
+// the class, and the number of samples in the bin.
+func (M *MultiClass) ReliabilityCurve(D *utils.DataBunch, class, bins int) ([]float64, []float64, []int) {
+	targets := M.calibrationTargets(D)
+	probs := make([]float64, len(D.Data))
+	for i, v := range D.Data {
+		probs[i] = M.PredictSingle(v)[class]
+	}
+	return utils.ReliabilityCurve(probs, utils.DenseCol(targets, class).RawRowView(0), bins)
+}
+
+// Returns the expected calibration error of the ensemble on the data D, with the given
+// number of bins. For multi-class ensembles, it uses the probability of the
+// predicted class for each sample, for multi-label ones, all the (sample, label) probabilities.
+func (M *MultiClass) ECE(D *utils.DataBunch, bins int) float64 {
+	targets := M.calibrationTargets(D)
+	probs := make([]float64, 0, len(D.Data))
+	outcomes := make([]float64, 0, len(D.Data))
+	for i, v := range D.Data {
+		p := M.PredictSingle(v)
+		if M.probTransformName == "sigmoid" {
+			probs = append(probs, p...)
+			outcomes = append(outcomes, targets.RawRowView(i)...)
+			continue
+		}
+		best := 0
+		for k, w := range p {
+			if w > p[best] {
+				best = k
+			}
+		}
+		probs = append(probs, p[best])
+		outcomes = append(outcomes, targets.At(i, best))
+	}
+	return utils.ECE(probs, outcomes, bins)
+}
@@ -0,0 +1,131 @@
+package boo
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Writes to w a standalone Go source file, in the package pkg, with functions to obtain
+// predictions from the ensemble M. The file has no dependencies other than the standard
+// library. It contains a variable <prefix>ClassLabels, with the class labels, and the functions
+// <prefix>PredictRaw, <prefix>Predict and <prefix>PredictClass, which take a data vector and return
+// the raw predictions (margins), the probabilities for each class (in the order of
+// <prefix>ClassLabels) and the label of the most likely class, respectively. The trees are
+// written as nested if/else statements. The prefix is "Model" by default.
+func GenerateGo(M *MultiClass, w io.Writer, pkg string, prefix ...string) error {
+	p := "Model"
+	if len(prefix) > 0 && prefix[0] != "" {
+		p = prefix[0]
+	}
+	lp := strings.ToLower(p[:1]) + p[1:]
+	C := M.Compile()
+	k := len(C.ClassLabels)
+	b := new(bytes.Buffer)
+	f := func(v float64) string { return strconv.FormatFloat(v, 'g', -1, 64) }
+	fmt.Fprintf(b, "// Code generated by boo. DO NOT EDIT.\n\npackage %s\n\n", pkg)
+	if C.Activation() != "normalization" || M.calibration != nil {
+		b.WriteString("import \"math\"\n\n")
+	}
+	labels := make([]string, 0, k)
+	for _, v := range C.ClassLabels {
+		labels = append(labels, strconv.Itoa(v))
+	}
+	fmt.Fprintf(b, "// The class labels, in the order of the predictions.\nvar %sClassLabels = []int{%s}\n\n", p, strings.Join(labels, ", "))
+	for t, tree := range C.Trees {
+		if C.Class[t] >= 0 {
+			fmt.Fprintf(b, "func %sTree%d(x []float64) float64 {\n", lp, t)
+		} else {
+			fmt.Fprintf(b, "func %sTree%d(x []float64, raw []float64, w float64) {\n", lp, t)
+		}
+		writeGoNode(b, tree, 0, f)
+		b.WriteString("}\n\n")
+	}
+	fmt.Fprintf(b, "// Returns the raw predictions (margins) for each class, for the data vector x.\nfunc %sPredictRaw(x []float64) []float64 {\n", p)
+	base := make([]string, 0, k)
+	for _, v := range C.BaseScores {
+		base = append(base, f(v))
+	}
+	fmt.Fprintf(b, "raw := []float64{%s}\n", strings.Join(base, ", "))
+	for t := range C.Trees {
+		if c := C.Class[t]; c >= 0 {
+			fmt.Fprintf(b, "raw[%d] += %s * %sTree%d(x)\n", c, f(C.Weight[t]), lp, t)
+		} else {
+			fmt.Fprintf(b, "%sTree%d(x, raw, %s)\n", lp, t, f(C.Weight[t]))
+		}
+	}
+	b.WriteString("return raw\n}\n\n")
+	fmt.Fprintf(b, "// Returns the probability of the data vector x belonging to each class.\nfunc %sPredict(x []float64) []float64 {\np := %sPredictRaw(x)\n", p, p)
+	switch C.Activation() {
+	case "softmax":
+		b.WriteString("var sum float64\nfor i, v := range p {\np[i] = math.Exp(v)\nsum += p[i]\n}\nfor i := range p {\np[i] /= sum\n}\n")
+	case "normalization":
+		b.WriteString("var sum float64\nfor _, v := range p {\nsum += v\n}\nfor i := range p {\np[i] /= sum\n}\n")
+	case "sigmoid":
+		b.WriteString("for i, v := range p {\np[i] = 1 / (1 + math.Exp(-v))\n}\n")
+	default:
+		return fmt.Errorf("Activation function %q not supported for code generation", C.Activation())
+	}
+	if cal := M.calibration; cal != nil {
+		switch cal.Method {
+		case "platt":
+			fmt.Fprintf(b, "a := %#v\nb := %#v\n", cal.A, cal.B)
+			b.WriteString("for i, v := range p {\nv = math.Min(math.Max(v, 1e-12), 1-1e-12)\np[i] = 1 / (1 + math.Exp(a[i]*math.Log(v/(1-v))+b[i]))\n}\n")
+		case "isotonic":
+			fmt.Fprintf(b, "xs := %#v\nys := %#v\n", cal.X, cal.Y)
+			b.WriteString(`for i, v := range p {
+x, y := xs[i], ys[i]
+switch {
+case len(x) == 0:
+case v <= x[0]:
+p[i] = y[0]
+case v >= x[len(x)-1]:
+p[i] = y[len(y)-1]
+default:
+j := 1
+for x[j] < v {
+j++
+}
+p[i] = y[j-1] + (v-x[j-1])/(x[j]-x[j-1])*(y[j]-y[j-1])
+}
+}
+`)
+		default:
+			return fmt.Errorf("Calibration method %q not supported for code generation", cal.Method)
+		}
+		if cal.Normalize {
+			b.WriteString("var csum float64\nfor _, v := range p {\ncsum += v\n}\nif csum > 0 {\nfor i := range p {\np[i] /= csum\n}\n}\n")
+		}
+	}
+	b.WriteString("return p\n}\n\n")
+	fmt.Fprintf(b, "// Returns the label of the most likely class for the data vector x.\nfunc %sPredictClass(x []float64) int {\np := %sPredict(x)\nbest := 0\nfor i, v := range p {\nif v > p[best] {\nbest = i\n}\n}\nreturn %sClassLabels[best]\n}\n", p, p, p)
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		return fmt.Errorf("Error formatting the generated code: %v", err)
+	}
+	_, err = w.Write(src)
+	return err
+}
+
+// Writes the node n of the compiled tree, and its descendants, as nested if/else
+// statements.
+func writeGoNode(b *bytes.Buffer, tree *CompiledTree, n int, f func(float64) string) {
+	if tree.Feature[n] < 0 {
+		if tree.Values == nil {
+			fmt.Fprintf(b, "return %s\n", f(tree.Value[n]))
+			return
+		}
+		for k, v := range tree.Values[n*tree.Outputs : (n+1)*tree.Outputs] {
+			fmt.Fprintf(b, "raw[%d] += w * %s\n", k, f(v))
+		}
+		return
+	}
+	fmt.Fprintf(b, "if x[%d] <= %s {\n", tree.Feature[n], f(tree.Threshold[n]))
+	writeGoNode(b, tree, tree.Left[n], f)
+	b.WriteString("} else {\n")
+	writeGoNode(b, tree, tree.Right[n], f)
+	b.WriteString("}\n")
+}
@@ -0,0 +1,213 @@
+package boo
+
+import (
+	"github.com/rmera/boo/utils"
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+// CompiledTree is a tree stored in flat arrays, with one element per node. The nodes
+// are in preorder, so the root is node 0, the left child of a split node i is always
+// node i+1, and node i corresponds to the node with ID i+1 in the JSON serialization.
+type CompiledTree struct {
+	Feature   []int     //the split feature of each node, -1 for leaves
+	Threshold []float64 //samples with feature <= threshold go to the left child
+	Left      []int
+	Right     []int
+	Value     []float64 //node values. Only meaningful for leaves.
+	Outputs   int       //number of values per node, more than 1 only for vector-leaf trees
+	Values    []float64 //for vector-leaf trees, the Outputs values of node i start at i*Outputs
+}
+
+// Returns the compiled version of the tree.
+func (T *Tree) Compile() *CompiledTree {
+	n := T.branches
+	ret := &CompiledTree{
+		Feature:   make([]int, 0, n),
+		Threshold: make([]float64, 0, n),
+		Left:      make([]int, 0, n),
+		Right:     make([]int, 0, n),
+		Value:     make([]float64, 0, n),
+		Outputs:   1,
+	}
+	if T.VectorLeaf() {
+		ret.Outputs = T.outputs()
+		ret.Values = make([]float64, 0, n*ret.Outputs)
+	}
+	ret.add(T)
+	return ret
+}
+
+// Adds the node T and its descendants to the compiled tree, in preorder,
+// and returns the index of T.
+func (C *CompiledTree) add(T *Tree) int {
+	i := len(C.Feature)
+	C.Feature = append(C.Feature, -1)
+	C.Threshold = append(C.Threshold, T.threshold)
+	C.Left = append(C.Left, -1)
+	C.Right = append(C.Right, -1)
+	C.Value = append(C.Value, T.value)
+	if C.Values != nil {
+		v := T.values
+		if v == nil {
+			v = make([]float64, C.Outputs)
+		}
+		C.Values = append(C.Values, v...)
+	}
+	if T.Leaf() {
+		return i
+	}
+	C.Feature[i] = T.splitFeatureIndex
+	C.Left[i] = C.add(T.left)
+	C.Right[i] = C.add(T.right)
+	return i
+}
+
+// Returns the index of the leaf in which the data vector falls.
+func (C *CompiledTree) Leaf(row []float64) int {
+	n := 0
+	for f := C.Feature[0]; f >= 0; f = C.Feature[n] {
+		if row[f] <= C.Threshold[n] {
+			n = C.Left[n]
+		} else {
+			n = C.Right[n]
+		}
+	}
+	return n
+}
+
+// Returns the value of the leaf in which the data vector falls.
+func (C *CompiledTree) PredictSingle(row []float64) float64 {
+	return C.Value[C.Leaf(row)]
+}
+
+// CompiledModel is a multi-class ensemble where each tree is compiled into
+// flat arrays, for faster predictions. It can't be trained further.
+type CompiledModel struct {
+	Trees       []*CompiledTree
+	Class       []int     //the class (output) of each tree, -1 for vector-leaf trees
+	Weight      []float64 //the factor (learning rate times tree weight) for the output of each tree
+	BaseScores  []float64 //the base score of each class
+	ClassLabels []int
+	NFeatures   int //the number of features of the training data, 0 if not known
+	activation  string
+	activate    func([]float64) []float64 //applies the activation function in place
+	calibration *utils.Calibration
+}
+
+// Returns a compiled version of the ensemble, for faster predictions. It works
+// for freshly trained as well as deserialized ensembles.
+func (M *MultiClass) Compile() *CompiledModel {
+	ret := &CompiledModel{BaseScores: M.BaseScores(), ClassLabels: M.ClassLabels(), NFeatures: M.nfeatures, activation: M.probTransformName, calibration: M.calibration}
+	ret.activate = rowActivation(M.probTransformName, M.probTransform)
+	for round, ensemble := range M.b {
+		for class, tree := range ensemble {
+			ret.Trees = append(ret.Trees, tree.Compile())
+			c := class
+			if tree.VectorLeaf() {
+				c = -1
+			}
+			ret.Class = append(ret.Class, c)
+			ret.Weight = append(ret.Weight, M.learningRate*M.treeWeight(round, class))
+		}
+	}
+	return ret
+}
+
+// Returns the name of the activation function of the ensemble.
+func (C *CompiledModel) Activation() string {
+	return C.activation
+}
+
+// Returns an error if the sample has fewer features than the training data. See
+// MultiClass.CheckInput.
+func (C *CompiledModel) CheckInput(instance []float64) error {
+	return checkInput(instance, C.NFeatures)
+}
+
+// Fills raw (which is allocated if nil) with the raw predictions (margins) of the
+// ensemble for the instance, and returns it. Panics if the sample has fewer features
+// than the training data.
+func (C *CompiledModel) PredictSingleRaw(instance []float64, raw []float64) []float64 {
+	if err := C.CheckInput(instance); err != nil {
+		panic(err.Error())
+	}
+	if len(raw) < len(C.ClassLabels) {
+		raw = make([]float64, len(C.ClassLabels))
+	}
+	raw = raw[:len(C.ClassLabels)]
+	copy(raw, C.BaseScores)
+	for t, tree := range C.Trees {
+		leaf := tree.Leaf(instance)
+		if c := C.Class[t]; c >= 0 {
+			raw[c] += tree.Value[leaf] * C.Weight[t]
+			continue
+		}
+		for k, v := range tree.Values[leaf*tree.Outputs : (leaf+1)*tree.Outputs] {
+			raw[k] += v * C.Weight[t]
+		}
+	}
+	return raw
+}
+
+// Returns a slice with the probability of the sample belonging to each class. You can supply
+// a slice to be filled with the predictions in order to avoid allocation. Panics if the
+// sample has fewer features than the training data, see PredictSingleErr.
+func (C *CompiledModel) PredictSingle(instance []float64, predictions ...[]float64) []float64 {
+	var preds []float64
+	if len(predictions) > 0 {
+		preds = predictions[0]
+	}
+	preds = C.activate(C.PredictSingleRaw(instance, preds))
+	if C.calibration != nil {
+		preds = C.calibration.Apply(preds)
+	}
+	return preds
+}
+
+// Same as PredictSingle, but returns an error, instead of panicking, if the sample has fewer
+// features than the training data.
+func (C *CompiledModel) PredictSingleErr(instance []float64, predictions ...[]float64) ([]float64, error) {
+	if err := C.CheckInput(instance); err != nil {
+		return nil, err
+	}
+	return C.PredictSingle(instance, predictions...), nil
+}
+
+// Returns an nxk matrix, where n is the number of data vectors and k the number of classes,
+// with the probability of each sample belonging to each class. The rows are processed
+// concurrently by the given number of workers (by default, GOMAXPROCS). Returns nil if
+// there is no data.
+func (C *CompiledModel) Predict(data [][]float64, workers ...int) *mat.Dense {
+	if len(data) == 0 {
+		return nil
+	}
+	ret := mat.NewDense(len(data), len(C.ClassLabels), nil)
+	parallelRows(len(data), workers, func(i int) {
+		C.PredictSingle(data[i], ret.RawRowView(i))
+	})
+	return ret
+}
+
+// Same as Predict, but all the data vectors are checked first, and an error is returned,
+// instead of panicking, if any has fewer features than the training data.
+func (C *CompiledModel) PredictErr(data [][]float64, workers ...int) (*mat.Dense, error) {
+	if err := checkRows(data, C.NFeatures); err != nil {
+		return nil, err
+	}
+	return C.Predict(data, workers...), nil
+}
+
+// Returns the predicted class label for each data vector. The rows are processed
+// concurrently by the given number of workers (by default, GOMAXPROCS).
+func (C *CompiledModel) PredictClasses(data [][]float64, workers ...int) []int {
+	ret := make([]int, len(data))
+	if len(data) == 0 {
+		return ret
+	}
+	probs := C.Predict(data, workers...)
+	for i := range ret {
+		ret[i] = C.ClassLabels[floats.MaxIdx(probs.RawRowView(i))]
+	}
+	return ret
+}
@@ -0,0 +1,187 @@
+package boo
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sync"
+
+	"github.com/rmera/boo/utils"
+)
+
+// Contains options to create a random forest classifier.
+type ForestOptions struct {
+	Trees          int     //number of bagged trees (each with one tree per class)
+	MaxDepth       int     //
+	MinChildWeight float64 //the minimum samples in each leaf
+	SubSample      float64 //size of each bootstrap sample, as a fraction of the data
+	ColSubSample   float64 //fraction of the features each tree can use. If 0, sqrt(features) are used.
+	NCPUs          int
+	Verbose        bool
+}
+
+// Returns a pointer to a ForestOptions structure with the default values
+// for a random forest classifier.
+func DefaultForestOptions() *ForestOptions {
+	O := new(ForestOptions)
+	O.Trees = 100
+	O.MaxDepth = 15
+	O.MinChildWeight = 1
+	O.SubSample = 1
+	O.ColSubSample = 0
+	O.NCPUs = 1
+	return O
+}
+
+// Returns a string representation of the options
+func (O *ForestOptions) String() string {
+	return fmt.Sprintf("forest %d t/%d md/%.3f mcw/%.3f ss/%.3f css", O.Trees, O.MaxDepth, O.MinChildWeight, O.SubSample, O.ColSubSample)
+}
+
+// RandomForest is a random forest classifier. It embeds a MultiClass where
+// each "round" contains one bagged tree per class, the learning rate is the inverse
+// of the number of bagged trees, and the activation function is a normalization, so
+// the forest can be used and serialized as any other MultiClass (use "normalization"
+// as the activation function name).
+type RandomForest struct {
+	*MultiClass
+	oobAccuracy float64
+}
+
+// Returns the out-of-bag accuracy of the forest, as a percentage. Each sample is
+// classified only with the trees for which it was not part of the bootstrap sample.
+// Samples that were used by all trees are not considered. It returns -1
+// if no sample was left out of the bootstrap samples.
+func (R *RandomForest) OOBAccuracy() float64 {
+	return R.oobAccuracy
+}
+
+// Produces (and fits) a new random forest classifier. The bagged trees
+// are grown concurrently, using up to opts[0].NCPUs gorutines.
+func NewRandomForest(D *utils.DataBunch, opts ...*ForestOptions) *RandomForest {
+	var O *ForestOptions
+	if len(opts) > 0 && opts[0] != nil {
+		O = opts[0]
+	} else {
+		O = DefaultForestOptions()
+	}
+	ncpus := O.NCPUs
+	if ncpus < 1 {
+		ncpus = 1
+	}
+	ohelabels, differentlabels := D.OHELabels()
+	nlabels := len(differentlabels)
+	ndata := len(D.Data)
+	nfeat := len(D.Data[0])
+	nbag := int(float64(ndata) * O.SubSample)
+	if nbag < 1 {
+		nbag = ndata
+	}
+	ncols := int(float64(nfeat) * O.ColSubSample)
+	if O.ColSubSample <= 0 {
+		ncols = int(math.Round(math.Sqrt(float64(nfeat))))
+	}
+	if ncols < 1 || ncols > nfeat {
+		ncols = nfeat
+	}
+	labels := make([][]float64, nlabels)
+	for k := range labels {
+		labels[k] = utils.DenseCol(ohelabels, k).RawRowView(0)
+	}
+	//The samples are drawn here, so the random number generation doesn't
+	//depend on the scheduling of the gorutines.
+	bags := make([][]int, O.Trees)
+	cols := make([][]int, O.Trees)
+	inbag := make([][]bool, O.Trees)
+	for i := range bags {
+		bags[i] = make([]int, nbag)
+		inbag[i] = make([]bool, ndata)
+		for j := range bags[i] {
+			bags[i][j] = rand.IntN(ndata)
+			inbag[i][bags[i][j]] = true
+		}
+		if ncols < nfeat {
+			cols[i] = rand.Perm(nfeat)[:ncols]
+		}
+	}
+	trees := make([][]*Tree, O.Trees)
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range ncpus {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			//each gorutine has its own temporary storage
+			tin := make([]int, nbag)
+			tval := make([]float64, nbag)
+			for i := range jobs {
+				classes := make([]*Tree, 0, nlabels)
+				for k := 0; k < nlabels; k++ {
+					tOpts := DefaultGTreeOptions()
+					tOpts.MaxDepth = O.MaxDepth
+					tOpts.MinChildWeight = O.MinChildWeight
+					tOpts.Indexes = bags[i]
+					tOpts.AllowedColumns = cols[i]
+					tOpts.Y = labels[k]
+					tOpts.in = tin
+					tOpts.val = tval
+					classes = append(classes, NewTree(D.Data, tOpts))
+				}
+				trees[i] = classes
+			}
+		}()
+	}
+	for i := range trees {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	M := &MultiClass{b: trees, learningRate: 1 / float64(O.Trees), probTransform: utils.NormalizationDense, probTransformName: "normalization", classLabels: differentlabels, baseScore: 0, xgb: false}
+	M.setSchema(D, nil)
+	ret := &RandomForest{MultiClass: M}
+	ret.oobAccuracy = ret.oob(D, inbag)
+	if O.Verbose {
+		fmt.Printf("Random forest with %d trees, out-of-bag accuracy: %.3f\n", O.Trees, ret.oobAccuracy)
+	}
+	return ret
+}
+
+// Returns the out-of-bag accuracy of the forest for the data D, given, for each tree,
+// which samples were part of its bootstrap sample.
+func (R *RandomForest) oob(D *utils.DataBunch, inbag [][]bool) float64 {
+	right := 0
+	total := 0
+	votes := make([]float64, len(R.classLabels))
+	for i, v := range D.Data {
+		for k := range votes {
+			votes[k] = 0
+		}
+		used := false
+		for t, ensemble := range R.b {
+			if inbag[t][i] {
+				continue
+			}
+			used = true
+			for class, tree := range ensemble {
+				votes[class] += tree.PredictSingle(v)
+			}
+		}
+		if !used {
+			continue
+		}
+		total++
+		best := 0
+		for k, w := range votes {
+			if w > votes[best] {
+				best = k
+			}
+		}
+		if R.classLabels[best] == D.Labels[i] {
+			right++
+		}
+	}
+	if total == 0 {
+		return -1
+	}
+	return 100.0 * (float64(right) / float64(total))
+}
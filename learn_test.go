@@ -2,8 +2,17 @@ package boo
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"math"
+	"math/rand/v2"
 	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strings"
 	"testing"
 
 	"github.com/rmera/boo/utils"
@@ -298,3 +307,1892 @@ func TestFeatures(Te *testing.T) {
 	}
 	fmt.Println("GBoost:\n", feat.String())
 }
+
+// Returns a small, easy, 3-class synthetic data set, so tests don't depend
+// on data files.
+func synthData(n int, seed uint64) *utils.DataBunch {
+	r := rand.New(rand.NewPCG(seed, seed+1))
+	D := &utils.DataBunch{Keys: []string{"a", "b", "c", "d"}}
+	for i := 0; i < n; i++ {
+		class := i % 3
+		v := make([]float64, 4)
+		for j := range v {
+			v[j] = r.NormFloat64()
+		}
+		v[0] += 2 * float64(class)
+		v[1] -= 1.5 * float64(class)
+		D.Data = append(D.Data, v)
+		D.Labels = append(D.Labels, class)
+	}
+	return D
+}
+
+func TestDART(Te *testing.T) {
+	data := synthData(150, 1)
+	O := DefaultDARTOptions()
+	O.Rounds = 30
+	O.EarlyStop = 0
+	O.DropRate = 0.3
+	O.SkipDrop = 0.2
+	if err := O.Check(); err != nil {
+		Te.Fatal(err)
+	}
+	boosted := NewMultiClass(data, O)
+	acc := boosted.Accuracy(data)
+	fmt.Println("DART train set accuracy", acc, O)
+	if acc < 80 {
+		Te.Errorf("DART accuracy too low: %.3f", acc)
+	}
+	jtest := newjsonTester()
+	err := JSONMultiClass(boosted, "softmax", jtest)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	m, err := UnJSONMultiClass(bufio.NewReader(strings.NewReader(strings.Join(jtest.Str, ""))))
+	if err != nil {
+		Te.Fatal(err)
+	}
+	for _, v := range data.Data {
+		if !slices.Equal(m.PredictSingle(v), boosted.PredictSingle(v)) {
+			Te.Fatalf("Recovered DART ensemble predicts %v, original %v", m.PredictSingle(v), boosted.PredictSingle(v))
+		}
+	}
+}
+
+// Files in the old format used to be read without their last round.
+func TestUnJSONLastRound(Te *testing.T) {
+	data := synthData(150, 51)
+	O := DefaultXOptions()
+	O.Rounds = 6
+	O.EarlyStop = 0
+	boosted := NewMultiClass(data, O)
+	jtest := newjsonTester()
+	if err := JSONMultiClass(boosted, "softmax", jtest); err != nil {
+		Te.Fatal(err)
+	}
+	m, err := UnJSONMultiClass(bufio.NewReader(strings.NewReader(strings.Join(jtest.Str, ""))))
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if len(m.b) != len(boosted.b) {
+		Te.Fatalf("Recovered ensemble has %d rounds, original %d", len(m.b), len(boosted.b))
+	}
+	for _, v := range data.Data {
+		if !slices.Equal(m.PredictSingle(v), boosted.PredictSingle(v)) {
+			Te.Fatalf("Recovered ensemble predicts %v, original %v", m.PredictSingle(v), boosted.PredictSingle(v))
+		}
+	}
+}
+
+func TestRandomForest(Te *testing.T) {
+	data := synthData(150, 2)
+	O := DefaultForestOptions()
+	O.Trees = 30
+	O.NCPUs = 4
+	O.Verbose = true
+	rf := NewRandomForest(data, O)
+	acc := rf.Accuracy(data)
+	fmt.Println("Random forest train set accuracy", acc, "OOB accuracy", rf.OOBAccuracy())
+	if rf.OOBAccuracy() < 70 || acc < rf.OOBAccuracy() {
+		Te.Errorf("Unexpected random forest accuracies, train: %.3f OOB: %.3f", acc, rf.OOBAccuracy())
+	}
+	jtest := newjsonTester()
+	err := JSONMultiClass(rf.MultiClass, "normalization", jtest)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	m, err := UnJSONMultiClass(bufio.NewReader(strings.NewReader(strings.Join(jtest.Str, ""))))
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if m.Accuracy(data) != acc {
+		Te.Errorf("Recovered forest has accuracy %.3f, original %.3f", m.Accuracy(data), acc)
+	}
+}
+
+// Without row subsampling, MinSample doesn't apply, and all the rounds are fitted.
+// (rounds used to be skipped, as the sample count was taken as 0).
+func TestNoSubSampleRounds(Te *testing.T) {
+	data := synthData(150, 52)
+	O := DefaultXOptions()
+	O.SubSample = 1
+	O.Rounds = 7
+	O.EarlyStop = 0
+	O.MinSample = 50
+	boosted := NewMultiClass(data, O)
+	if len(boosted.b) != 7 {
+		Te.Errorf("Expected 7 rounds without subsampling, got %d", len(boosted.b))
+	}
+	O.SubSample = 0.1 //15 rows, less than MinSample, so every round is skipped.
+	if r := len(NewMultiClass(data, O).b); r != 0 {
+		Te.Errorf("Expected no rounds with too few subsampled rows, got %d", r)
+	}
+}
+
+func TestOOB(Te *testing.T) {
+	data := synthData(150, 3)
+	O := DefaultXOptions()
+	O.Rounds = 200
+	O.SubSample = 0.6
+	O.EarlyStop = 5
+	O.OOBEarlyStop = true
+	if err := O.Check(); err != nil {
+		Te.Fatal(err)
+	}
+	boosted := NewMultiClass(data, O)
+	loss := boosted.OOBLoss()
+	imp := boosted.OOBImprovement()
+	fmt.Println("OOB loss", loss, "\nOOB improvement", imp)
+	if len(loss) != len(boosted.b) || len(imp) != len(boosted.b) {
+		Te.Errorf("OOB curves of length %d and %d for %d rounds", len(loss), len(imp), len(boosted.b))
+	}
+	if len(boosted.b) >= O.Rounds {
+		Te.Errorf("Out-of-bag early stop didn't stop the training")
+	}
+	if loss[len(loss)-1] >= loss[0] {
+		Te.Errorf("OOB loss didn't decrease: %v", loss)
+	}
+}
+
+// Returns a synthetic ranking data set, with ngroups queries of 10 documents
+// each. The relevance (0-3) depends on the first two features.
+func synthRankData(ngroups int, seed uint64) *utils.DataBunch {
+	r := rand.New(rand.NewPCG(seed, seed+1))
+	D := &utils.DataBunch{}
+	for g := 0; g < ngroups; g++ {
+		for i := 0; i < 10; i++ {
+			v := []float64{r.Float64(), r.Float64(), r.Float64()}
+			rel := int(4 * (0.7*v[0] + 0.3*v[1]))
+			D.Data = append(D.Data, v)
+			D.Labels = append(D.Labels, rel)
+			D.Groups = append(D.Groups, g)
+		}
+	}
+	return D
+}
+
+func TestRank(Te *testing.T) {
+	data := synthRankData(30, 4)
+	test := synthRankData(10, 5)
+	O := DefaultXOptions()
+	O.Rounds = 30
+	O.EarlyStop = 0
+	O.BaseScore = 0
+	random := make([]float64, len(test.Data))
+	for i := range random {
+		random[i] = rand.Float64()
+	}
+	fmt.Printf("Random NDCG@5: %.3f MAP: %.3f\n", utils.MeanNDCG(test, random, 5), utils.MeanAP(test, random))
+	for _, obj := range []utils.Objective{&utils.PairwiseRank{}, &utils.LambdaRank{K: 5}} {
+		ranker := NewRegressor(data, obj, O)
+		scores := ranker.Predict(test.Data, nil)
+		ndcg := utils.MeanNDCG(test, scores, 5)
+		fmt.Printf("%s test NDCG@5: %.3f MAP: %.3f\n", obj.Name(), ndcg, utils.MeanAP(test, scores))
+		if ndcg < 0.85 {
+			Te.Errorf("Low NDCG@5 for %s: %.3f", obj.Name(), ndcg)
+		}
+	}
+	//Single-document queries have no pairs, so their Hessian is 0. Leaves with
+	//only such documents must get a 0, not a NaN.
+	single := synthRankData(3, 6)
+	for i := range single.Groups {
+		single.Groups[i] = 100 + i
+	}
+	mixed := &utils.DataBunch{Data: append(slices.Clone(data.Data), single.Data...), Labels: append(slices.Clone(data.Labels), single.Labels...), Groups: append(slices.Clone(data.Groups), single.Groups...)}
+	G := DefaultGOptions()
+	G.Rounds = 10
+	for _, D := range []*utils.DataBunch{single, mixed} {
+		for _, obj := range []utils.Objective{&utils.PairwiseRank{}, &utils.LambdaRank{K: 5}} {
+			ranker := NewRegressor(D, obj, G)
+			for _, v := range ranker.Predict(test.Data, nil) {
+				if math.IsNaN(v) || math.IsInf(v, 0) {
+					Te.Fatalf("%s with single-document queries predicts %v", obj.Name(), v)
+				}
+			}
+		}
+	}
+}
+
+// Returns a synthetic regression data set, y=3x0+x1+noise.
+func synthRegData(n int, seed uint64) *utils.DataBunch {
+	r := rand.New(rand.NewPCG(seed, seed+1))
+	D := &utils.DataBunch{}
+	for i := 0; i < n; i++ {
+		v := []float64{r.Float64(), r.Float64()}
+		D.Data = append(D.Data, v)
+		D.FloatLabels = append(D.FloatLabels, 3*v[0]+v[1]+0.3*r.NormFloat64())
+	}
+	return D
+}
+
+func TestQuantileRegression(Te *testing.T) {
+	data := synthRegData(400, 6)
+	test := synthRegData(400, 7)
+	for _, xgb := range []bool{true, false} {
+		O := DefaultGOptions()
+		if xgb {
+			O = DefaultXOptions()
+			O.SubSample = 1
+			O.ColSubSample = 1
+			O.Gamma = 0 //the gains are small, as the gradients are bounded
+		}
+		O.Rounds = 100
+		O.EarlyStop = 0
+		O.MaxDepth = 3
+		O.MinChildWeight = 20 //quantile leaves with few samples overfit easily
+		O.LearningRate = 0.1
+		O.BaseScore = 2 //the steps are small, as the gradients are bounded, so better start close to the median
+		for _, alpha := range []float64{0.1, 0.9} {
+			q := NewRegressor(data, &utils.QuantileLoss{Alpha: alpha}, O)
+			preds := q.Predict(data.Data, nil)
+			below := 0
+			for i, v := range preds {
+				if data.FloatLabels[i] < v {
+					below++
+				}
+			}
+			cov := float64(below) / float64(len(preds))
+			fmt.Printf("xgb: %v P%2.0f train coverage %.3f\n", xgb, 100*alpha, cov)
+			if math.Abs(cov-alpha) > 0.05 {
+				Te.Errorf("Bad coverage for quantile %.2f (xgb: %v): %.3f", alpha, xgb, cov)
+			}
+		}
+	}
+	for _, obj := range []utils.Objective{&utils.HuberLoss{Delta: 0.5}, &utils.PseudoHuberLoss{Delta: 0.5}} {
+		O := DefaultXOptions()
+		O.Rounds = 50
+		O.BaseScore = 2 //close to the mean, the pseudo-Huber hessian is tiny for large residuals
+		h := NewRegressor(data, obj, O)
+		raw := h.Predict(test.Data, nil)
+		loss := obj.Value(test, raw)
+		fmt.Printf("%s test loss %.3f\n", obj.Name(), loss)
+		if loss > 0.1 {
+			Te.Errorf("Large test loss for %s: %.3f", obj.Name(), loss)
+		}
+	}
+}
+
+// Returns a synthetic survival data set, with exponentially-distributed
+// times with a log-hazard 4*x0-2*x1, and about a third of the samples censored.
+func synthSurvData(n int, seed uint64) *utils.DataBunch {
+	r := rand.New(rand.NewPCG(seed, seed+1))
+	D := &utils.DataBunch{}
+	for i := 0; i < n; i++ {
+		v := []float64{r.Float64(), r.Float64(), r.Float64()}
+		t := r.ExpFloat64() / math.Exp(4*v[0]-2*v[1])
+		c := r.ExpFloat64() * 2.5
+		D.Data = append(D.Data, v)
+		D.Times = append(D.Times, math.Min(t, c))
+		D.Censored = append(D.Censored, c < t)
+	}
+	return D
+}
+
+func TestSurvival(Te *testing.T) {
+	data := synthSurvData(300, 8)
+	test := synthSurvData(300, 9)
+	O := DefaultXOptions()
+	O.Rounds = 30
+	O.EarlyStop = 0
+	O.MaxDepth = 2
+	O.LearningRate = 0.1
+	O.BaseScore = 0
+	cox := NewRegressor(data, &utils.CoxPH{}, O)
+	cindex := utils.ConcordanceIndex(test, cox.Predict(test.Data, nil))
+	fmt.Printf("Cox test C-index: %.3f\n", cindex)
+	if cindex < 0.65 {
+		Te.Errorf("Low C-index for Cox: %.3f", cindex)
+	}
+	aft := NewRegressor(data, &utils.AFT{Sigma: 1}, O)
+	times := aft.Predict(test.Data, nil)
+	for i := range times {
+		times[i] *= -1 //longer times, lower risk.
+	}
+	cindex = utils.ConcordanceIndex(test, times)
+	fmt.Printf("AFT test C-index: %.3f\n", cindex)
+	if cindex < 0.65 {
+		Te.Errorf("Low C-index for AFT: %.3f", cindex)
+	}
+}
+
+// Returns a synthetic claims data set. The number of claims is Poisson-distributed
+// with rate exp(x0-x1)*exposure, and each claim has an exponentially-distributed
+// amount with mean 2. FloatLabels are the counts, Times (ab)used for the total amounts.
+func synthClaimsData(n int, seed uint64) *utils.DataBunch {
+	r := rand.New(rand.NewPCG(seed, seed+1))
+	D := &utils.DataBunch{}
+	for i := 0; i < n; i++ {
+		v := []float64{2 * r.Float64(), r.Float64()}
+		exposure := 0.2 + r.Float64()
+		lambda := math.Exp(v[0]-v[1]) * exposure
+		counts := 0
+		for p := r.Float64(); p > math.Exp(-lambda); p *= r.Float64() {
+			counts++
+		}
+		amount := 0.0
+		for range counts {
+			amount += 2 * r.ExpFloat64()
+		}
+		D.Data = append(D.Data, v)
+		D.Exposure = append(D.Exposure, exposure)
+		D.FloatLabels = append(D.FloatLabels, float64(counts))
+		D.Times = append(D.Times, amount)
+	}
+	return D
+}
+
+func TestCountObjectives(Te *testing.T) {
+	data := synthClaimsData(500, 10)
+	test := synthClaimsData(500, 11)
+	O := DefaultXOptions()
+	O.Rounds = 50
+	O.EarlyStop = 0
+	O.MaxDepth = 2
+	O.LearningRate = 0.1
+	O.BaseScore = 0
+	poisson := NewRegressor(data, &utils.PoissonObj{}, O)
+	raw := make([]float64, len(test.Data))
+	for i, v := range test.Data {
+		raw[i] = poisson.PredictSingleRaw(v)
+	}
+	null := make([]float64, len(test.Data)) //exp(0)*exposure
+	dev, nulldev := (&utils.PoissonObj{}).Value(test, raw), (&utils.PoissonObj{}).Value(test, null)
+	fmt.Printf("Poisson test deviance: %.3f, null deviance: %.3f\n", dev, nulldev)
+	if dev >= 0.9*nulldev {
+		Te.Errorf("Poisson deviance %.3f not much better than the null deviance %.3f", dev, nulldev)
+	}
+	//Tweedie for the total amounts
+	data.FloatLabels, test.FloatLabels = data.Times, test.Times
+	tw := &utils.TweedieObj{Power: 1.5}
+	tweedie, err := FitRegressor(data, tw, O)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	for _, p := range []float64{1, 2.5, -1} {
+		if _, err := FitRegressor(data, &utils.TweedieObj{Power: p}, O); err == nil {
+			Te.Errorf("Fitting with a Tweedie power of %v should fail", p)
+		}
+	}
+	for i, v := range test.Data {
+		raw[i] = tweedie.PredictSingleRaw(v)
+	}
+	for i := range null {
+		null[i] = math.Log(2) //the mean amount per claim times the mean counts per exposure at x=0
+	}
+	dev, nulldev = tw.Value(test, raw), tw.Value(test, null)
+	fmt.Printf("Tweedie test deviance: %.3f, null deviance: %.3f\n", dev, nulldev)
+	if dev >= 0.9*nulldev {
+		Te.Errorf("Tweedie deviance %.3f not much better than the null deviance %.3f", dev, nulldev)
+	}
+	//Gamma for the amounts of the samples with claims.
+	claims := &utils.DataBunch{}
+	for i, v := range data.Data {
+		if data.FloatLabels[i] > 0 {
+			claims.Data = append(claims.Data, v)
+			claims.FloatLabels = append(claims.FloatLabels, data.FloatLabels[i])
+		}
+	}
+	gamma := NewRegressor(claims, &utils.GammaObj{}, O)
+	if p := gamma.PredictSingle([]float64{1, 0.5}); p < 1 || p > 10 {
+		Te.Errorf("Unreasonable Gamma prediction %.3f", p)
+	}
+}
+
+// Returns a synthetic multi-label data set, with 3 labels that depend
+// on different features.
+func synthMultiLabelData(n int, seed uint64) *utils.DataBunch {
+	r := rand.New(rand.NewPCG(seed, seed+1))
+	D := &utils.DataBunch{}
+	for i := 0; i < n; i++ {
+		v := []float64{r.NormFloat64(), r.NormFloat64(), r.NormFloat64()}
+		set := make([]int, 0, 3)
+		if v[0] > 0 {
+			set = append(set, 10)
+		}
+		if v[1] > 0 {
+			set = append(set, 20)
+		}
+		if v[0]+v[2] > 0.5 {
+			set = append(set, 30)
+		}
+		D.Data = append(D.Data, v)
+		D.LabelSets = append(D.LabelSets, set)
+	}
+	return D
+}
+
+func TestMultiLabel(Te *testing.T) {
+	data := synthMultiLabelData(300, 12)
+	test := synthMultiLabelData(200, 13)
+	O := DefaultXOptions()
+	O.Rounds = 30
+	O.EarlyStop = 0
+	O.BaseScore = 0
+	m := NewMultiLabel(data, O)
+	jtest := newjsonTester()
+	err := JSONMultiClass(m, m.Activation(), jtest)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	m, err = UnJSONMultiClass(bufio.NewReader(strings.NewReader(strings.Join(jtest.Str, ""))))
+	if err != nil {
+		Te.Fatal(err)
+	}
+	predicted := make([][]int, 0, len(test.Data))
+	for _, v := range test.Data {
+		predicted = append(predicted, m.PredictSingleLabels(v, 0.5))
+	}
+	labels := m.ClassLabels()
+	hl := utils.HammingLoss(test.LabelSets, predicted, labels)
+	sa := utils.SubsetAccuracy(test.LabelSets, predicted)
+	mi, ma := utils.MicroF1(test.LabelSets, predicted, labels), utils.MacroF1(test.LabelSets, predicted, labels)
+	fmt.Printf("Multi-label (%s) test Hamming loss: %.3f subset accuracy: %.3f micro F1: %.3f macro F1: %.3f\n", m.Activation(), hl, sa, mi, ma)
+	if hl > 0.15 || mi < 0.8 || ma < 0.8 {
+		Te.Errorf("Poor multi-label performance")
+	}
+}
+
+func TestMultiOutput(Te *testing.T) {
+	data := synthData(200, 14)
+	test := synthData(150, 15)
+	O := DefaultXOptions()
+	O.Rounds = 30
+	O.EarlyStop = 0
+	O.MultiOutput = true
+	if err := O.Check(); err != nil {
+		Te.Fatal(err)
+	}
+	boosted := NewMultiClass(data, O)
+	nclass := len(boosted.ClassLabels())
+	//every node knows the number of outputs, but only the leaves have values.
+	checkTrees := func(M *MultiClass) {
+		for _, round := range M.b {
+			if len(round) != 1 || !round[0].VectorLeaf() {
+				Te.Fatalf("Expected a single vector-leaf tree per round")
+			}
+			var check func(t *Tree)
+			check = func(t *Tree) {
+				if t.outputs() != nclass {
+					Te.Fatalf("Node with %d outputs, expected %d", t.outputs(), nclass)
+				}
+				if t.Leaf() {
+					return
+				}
+				if t.values != nil {
+					Te.Fatalf("Internal node with values")
+				}
+				check(t.left)
+				check(t.right)
+			}
+			check(round[0])
+		}
+	}
+	checkTrees(boosted)
+	func() {
+		defer func() {
+			if recover() == nil {
+				Te.Errorf("PredictSingle didn't panic for a vector-leaf tree")
+			}
+		}()
+		boosted.b[0][0].PredictSingle(test.Data[0])
+	}()
+	acc := boosted.Accuracy(test)
+	fmt.Println("Vector-leaf test set accuracy", acc, "rounds:", len(boosted.b))
+	if acc < 75 {
+		Te.Errorf("Vector-leaf accuracy too low: %.3f", acc)
+	}
+	jtest := newjsonTester()
+	err := JSONMultiClass(boosted, "softmax", jtest)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	m, err := UnJSONMultiClass(bufio.NewReader(strings.NewReader(strings.Join(jtest.Str, ""))))
+	if err != nil {
+		Te.Fatal(err)
+	}
+	var js bytes.Buffer
+	if err := WriteJSONModel(boosted, &js); err != nil {
+		Te.Fatal(err)
+	}
+	jm, err := ReadJSONModel(&js)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	b, err := boosted.MarshalBinary()
+	if err != nil {
+		Te.Fatal(err)
+	}
+	bm := &MultiClass{}
+	if err := bm.UnmarshalBinary(b); err != nil {
+		Te.Fatal(err)
+	}
+	for _, r := range []*MultiClass{m, jm, bm} {
+		checkTrees(r)
+		for _, v := range test.Data {
+			if !slices.Equal(r.PredictSingle(v), boosted.PredictSingle(v)) {
+				Te.Fatalf("Recovered vector-leaf ensemble predicts %v, original %v", r.PredictSingle(v), boosted.PredictSingle(v))
+			}
+		}
+	}
+}
+
+// Softmax cross-entropy, as a custom objective and metric.
+func softmaxCE(labels, raw []float64, k int) (loss float64, grads, hess []float64) {
+	grads = make([]float64, len(raw))
+	hess = make([]float64, len(raw))
+	for i := 0; i < len(raw); i += k {
+		row := raw[i : i+k]
+		m := slices.Max(row)
+		var s float64
+		for _, v := range row {
+			s += math.Exp(v - m)
+		}
+		for j, v := range row {
+			p := math.Exp(v-m) / s
+			grads[i+j] = p - labels[i+j]
+			hess[i+j] = math.Max(2*p*(1-p), 1e-6)
+			if labels[i+j] == 1 {
+				loss -= math.Log(p)
+			}
+		}
+	}
+	return loss / float64(len(raw)/k), grads, hess
+}
+
+func TestCustomObjective(Te *testing.T) {
+	data := synthData(200, 16)
+	test := synthData(150, 17)
+	calls := 0
+	O := DefaultXOptions()
+	O.Rounds = 40
+	O.EarlyStop = 3
+	O.Objective = func(labels, raw []float64) ([]float64, []float64) {
+		calls++
+		_, g, h := softmaxCE(labels, raw, 3)
+		return g, h
+	}
+	O.Metric = func(labels, raw []float64) float64 {
+		l, _, _ := softmaxCE(labels, raw, 3)
+		return l
+	}
+	if err := O.Check(); err != nil {
+		Te.Fatal(err)
+	}
+	boosted := NewMultiClass(data, O)
+	acc := boosted.Accuracy(test)
+	fmt.Println("Custom objective test set accuracy", acc, "rounds:", len(boosted.b), "calls:", calls)
+	if acc < 75 || calls == 0 {
+		Te.Errorf("Custom objective accuracy too low: %.3f", acc)
+	}
+	if calls != len(boosted.b) {
+		Te.Errorf("The custom objective should be called once per round, called %d times for %d rounds", calls, len(boosted.b))
+	}
+	O.Objective = func(labels, raw []float64) ([]float64, []float64) {
+		return make([]float64, len(raw)), make([]float64, len(raw)-1)
+	}
+	if _, err := FitMultiClass(data, O); err == nil {
+		Te.Errorf("Expected an error for a custom objective with the wrong number of Hessian elements")
+	}
+	O.MultiOutput = true
+	if _, err := FitMultiClass(data, O); err == nil {
+		Te.Errorf("Expected an error for a vector-leaf ensemble with a wrong custom objective")
+	}
+	//a custom squared error for the Regressor
+	rdata := synthRegData(300, 18)
+	sqerr := func(labels, raw []float64) ([]float64, []float64) {
+		g := make([]float64, len(raw))
+		h := make([]float64, len(raw))
+		for i, v := range raw {
+			g[i] = v - labels[i]
+			h[i] = 1
+		}
+		return g, h
+	}
+	mse := func(labels, raw []float64) float64 {
+		var ret float64
+		for i, v := range raw {
+			ret += (v - labels[i]) * (v - labels[i])
+		}
+		return ret / float64(len(raw))
+	}
+	RO := DefaultXOptions()
+	RO.Rounds = 50
+	RO.EarlyStop = 0
+	reg := NewRegressor(rdata, utils.NewCustomObjective("custom:sqerr", sqerr, mse), RO)
+	preds := reg.Predict(rdata.Data, nil)
+	if l := mse(rdata.FloatLabels, preds); l > 0.2 || reg.Objective() != "custom:sqerr" {
+		Te.Errorf("Custom regression objective: MSE too high %.3f", l)
+	}
+}
+
+func TestCalibration(Te *testing.T) {
+	data := synthData(300, 19)
+	held := synthData(600, 20)
+	test := synthData(600, 21)
+	O := DefaultXOptions()
+	O.Rounds = 60
+	O.EarlyStop = 0
+	O.LearningRate = 0.5
+	O.MaxDepth = 6
+	O.MinChildWeight = 1
+	O.Gamma = 0
+	boosted := NewMultiClass(data, O)
+	ece := boosted.ECE(test, 10)
+	for _, method := range []string{"platt", "isotonic"} {
+		cal, err := boosted.Calibrate(held, method)
+		if err != nil {
+			Te.Fatal(err)
+		}
+		if boosted.IsCalibrated() || !cal.IsCalibrated() {
+			Te.Fatalf("Calibrate should return a calibrated copy")
+		}
+		calece := cal.ECE(test, 10)
+		fmt.Printf("ECE uncalibrated: %.3f %s: %.3f\n", ece, method, calece)
+		if calece > ece {
+			Te.Errorf("Calibration (%s) increased the ECE from %.3f to %.3f", method, ece, calece)
+		}
+		meanp, frac, counts := cal.ReliabilityCurve(test, 0, 5)
+		fmt.Println("Reliability curve, class 0:", meanp, frac, counts)
+		jtest := newjsonTester()
+		err = JSONMultiClass(cal, "softmax", jtest)
+		if err != nil {
+			Te.Fatal(err)
+		}
+		m, err := UnJSONMultiClass(bufio.NewReader(strings.NewReader(strings.Join(jtest.Str, ""))))
+		if err != nil {
+			Te.Fatal(err)
+		}
+		for _, v := range test.Data[:20] {
+			p := m.PredictSingle(v)
+			if !slices.Equal(p, cal.PredictSingle(v)) {
+				Te.Fatalf("Recovered calibrated ensemble predicts %v, original %v", p, cal.PredictSingle(v))
+			}
+			if s := p[0] + p[1] + p[2]; math.Abs(s-1) > 1e-9 {
+				Te.Errorf("Calibrated probabilities add up to %.6f", s)
+			}
+		}
+	}
+}
+
+func TestBatchPredict(Te *testing.T) {
+	data := synthData(200, 22)
+	test := synthData(500, 23)
+	O := DefaultXOptions()
+	O.Rounds = 15
+	boosted := NewMultiClass(data, O)
+	probs := boosted.Predict(test.Data, 4)
+	classes := boosted.PredictClasses(test.Data, 3)
+	labels := boosted.ClassLabels()
+	for i, v := range test.Data {
+		if !slices.Equal(probs.RawRowView(i), boosted.PredictSingle(v)) {
+			Te.Fatalf("Batch prediction %v differs from single prediction %v", probs.RawRowView(i), boosted.PredictSingle(v))
+		}
+		if classes[i] != labels[boosted.PredictSingleClass(v)] {
+			Te.Fatalf("Batch class %d differs from single class %d", classes[i], labels[boosted.PredictSingleClass(v)])
+		}
+	}
+	buf := make([]float64, len(labels))
+	allocs := testing.AllocsPerRun(100, func() { boosted.PredictSingle(test.Data[0], buf) })
+	if allocs > 0 {
+		Te.Errorf("PredictSingle with a buffer allocates %.1f times per call", allocs)
+	}
+}
+
+func BenchmarkPredict(b *testing.B) {
+	data := synthData(200, 22)
+	test := synthData(10000, 23)
+	boosted := NewMultiClass(data, DefaultXOptions())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		boosted.Predict(test.Data)
+	}
+}
+
+func TestRawAndLeaf(Te *testing.T) {
+	data := synthData(200, 24)
+	O := DefaultXOptions()
+	O.Rounds = 10
+	boosted := NewMultiClass(data, O)
+	raw := boosted.PredictRaw(data.Data, 2)
+	leaves := boosted.PredictLeaf(data.Data, 2)
+	//the JSON nodes for each tree, by id
+	nodes := make([]map[uint]*utils.JSONNode, 0)
+	trees := make([]*Tree, 0)
+	for _, round := range boosted.b {
+		for _, tree := range round {
+			jtree, _, err := utils.JSONTree(tree)
+			if err != nil {
+				Te.Fatal(err)
+			}
+			m := make(map[uint]*utils.JSONNode)
+			for _, v := range jtree {
+				n := new(utils.JSONNode)
+				if err := json.Unmarshal(v, n); err != nil {
+					Te.Fatal(err)
+				}
+				m[n.Id] = n
+			}
+			nodes = append(nodes, m)
+			trees = append(trees, tree)
+		}
+	}
+	for i, v := range data.Data {
+		r := raw.RawRowView(i)
+		if !slices.Equal(r, boosted.PredictSingleRaw(v)) {
+			Te.Fatalf("Batch raw prediction %v differs from single one %v", r, boosted.PredictSingleRaw(v))
+		}
+		p := utils.SoftMax(r, nil)
+		for k, w := range boosted.PredictSingle(v) {
+			if math.Abs(w-p[k]) > 1e-12 {
+				Te.Fatalf("Softmax of the margins %v differs from the probabilities", p)
+			}
+		}
+		if len(leaves[i]) != len(trees) {
+			Te.Fatalf("%d leaf indexes for %d trees", len(leaves[i]), len(trees))
+		}
+		for t, id := range leaves[i] {
+			n, ok := nodes[t][uint(id)]
+			if !ok || !n.Leaf || n.Value != trees[t].PredictSingle(v) {
+				Te.Fatalf("Leaf index %d of tree %d doesn't match the JSON node %v", id, t, n)
+			}
+		}
+	}
+}
+
+func TestRoundRange(Te *testing.T) {
+	data := synthData(200, 25)
+	test := synthData(200, 26)
+	O := DefaultDARTOptions()
+	O.Rounds = 20
+	O.EarlyStop = 0
+	boosted := NewMultiClass(data, O)
+	if _, err := boosted.Slice(5, 5); err == nil {
+		Te.Errorf("Empty round range should fail")
+	}
+	if _, err := boosted.Truncate(boosted.Rounds() + 100); err == nil {
+		Te.Errorf("Out of range truncation should fail")
+	}
+	n := len(boosted.b)
+	for _, rng := range [][2]int{{0, 5}, {3, 9}, {0, n}} {
+		m, err := boosted.Slice(rng[0], rng[1])
+		if err != nil {
+			Te.Fatal(err)
+		}
+		if len(m.b) != rng[1]-rng[0] || len(m.OOBLoss()) != len(m.b) {
+			Te.Fatalf("Slice %v has %d rounds and %d OOB losses", rng, len(m.b), len(m.OOBLoss()))
+		}
+		for _, v := range test.Data {
+			if !slices.Equal(m.PredictSingle(v), boosted.PredictSingleRange(v, rng[0], rng[1])) {
+				Te.Fatalf("Slice %v predicts %v, range prediction %v", rng, m.PredictSingle(v), boosted.PredictSingleRange(v, rng[0], rng[1]))
+			}
+		}
+	}
+	for _, r := range []int{1, 5, 10, n} {
+		m, _ := boosted.Truncate(r)
+		fmt.Printf("Test accuracy with %d rounds: %.3f\n", r, m.Accuracy(test))
+	}
+}
+
+func TestCompile(Te *testing.T) {
+	data := synthData(200, 27)
+	test := synthData(200, 28)
+	models := make([]*MultiClass, 0)
+	for _, O := range []*Options{DefaultXOptions(), DefaultGOptions(), DefaultDARTOptions(), DefaultXOptions()} {
+		O.Rounds = 10
+		models = append(models, NewMultiClass(data, O))
+	}
+	models[3] = NewMultiClass(data, &Options{XGB: true, MultiOutput: true, Rounds: 10, MaxDepth: 4, LearningRate: 0.3, Lambda: 1, MinChildWeight: 2, SubSample: 1, ColSubSample: 1, Loss: &utils.SQErrLoss{}})
+	cal, err := models[0].Calibrate(test, "isotonic")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	models = append(models, cal)
+	jtest := newjsonTester()
+	if err := JSONMultiClass(models[1], "softmax", jtest); err != nil {
+		Te.Fatal(err)
+	}
+	m, err := UnJSONMultiClass(bufio.NewReader(strings.NewReader(strings.Join(jtest.Str, ""))))
+	if err != nil {
+		Te.Fatal(err)
+	}
+	models = append(models, m)
+	for n, m := range models {
+		c := m.Compile()
+		probs := c.Predict(test.Data, 2)
+		classes := c.PredictClasses(test.Data)
+		ref := m.PredictClasses(test.Data)
+		for i, v := range test.Data {
+			p := m.PredictSingle(v)
+			for k, w := range probs.RawRowView(i) {
+				if math.Abs(w-p[k]) > 1e-12 {
+					Te.Fatalf("Model %d: compiled prediction %v differs from original %v", n, probs.RawRowView(i), p)
+				}
+			}
+			if classes[i] != ref[i] {
+				Te.Fatalf("Model %d: compiled class %d differs from original %d", n, classes[i], ref[i])
+			}
+			leaves := m.PredictSingleLeaf(v)
+			for t, tree := range c.Trees {
+				if tree.Leaf(v)+1 != leaves[t] {
+					Te.Fatalf("Model %d: compiled leaf %d for tree %d, original %d", n, tree.Leaf(v), t, leaves[t])
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkCompiledPredict(b *testing.B) {
+	data := synthData(200, 22)
+	test := synthData(10000, 23)
+	boosted := NewMultiClass(data, DefaultXOptions()).Compile()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		boosted.Predict(test.Data)
+	}
+}
+
+func TestGenerateGo(Te *testing.T) {
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		Te.Skip("go toolchain not found")
+	}
+	data := synthData(150, 29)
+	test := synthData(30, 30)
+	O := DefaultXOptions()
+	O.Rounds = 8
+	models := map[string]*MultiClass{"Xgb": NewMultiClass(data, O)}
+	VO := O.Clone()
+	VO.MultiOutput = true
+	models["Vector"] = NewMultiClass(data, VO)
+	models["Platt"], err = models["Xgb"].Calibrate(test, "platt")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	models["Iso"], err = models["Xgb"].Calibrate(test, "isotonic")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	FO := DefaultForestOptions()
+	FO.Trees = 5
+	models["Forest"] = NewRandomForest(data, FO).MultiClass
+	dir := Te.TempDir()
+	var main strings.Builder
+	fmt.Fprintf(&main, "package main\n\nimport (\n\"encoding/json\"\n\"os\"\n)\n\nfunc main() {\ndata := %#v\nret := map[string][][]float64{}\nfor _, v := range data {\n", test.Data)
+	for name, m := range models {
+		f, err := os.Create(dir + "/" + strings.ToLower(name) + ".go")
+		if err != nil {
+			Te.Fatal(err)
+		}
+		if err := GenerateGo(m, f, "main", name); err != nil {
+			Te.Fatal(err)
+		}
+		f.Close()
+		fmt.Fprintf(&main, "ret[%q] = append(ret[%q], %sPredict(v))\n", name, name, name)
+	}
+	main.WriteString("}\njson.NewEncoder(os.Stdout).Encode(ret)\n}\n")
+	if err := os.WriteFile(dir+"/main.go", []byte(main.String()), 0644); err != nil {
+		Te.Fatal(err)
+	}
+	cmd := exec.Command(gobin, "run", ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GO111MODULE=off")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		Te.Fatalf("Error running generated code: %v %s", err, out)
+	}
+	preds := map[string][][]float64{}
+	if err := json.Unmarshal(out, &preds); err != nil {
+		Te.Fatal(err)
+	}
+	for name, m := range models {
+		for i, v := range test.Data {
+			for k, p := range m.PredictSingle(v) {
+				if math.Abs(p-preds[name][i][k]) > 1e-12 {
+					Te.Fatalf("Generated code for model %s predicts %v, original %v", name, preds[name][i], m.PredictSingle(v))
+				}
+			}
+		}
+	}
+}
+
+// A small, hand-written multi:softprob model, in the format of XGBoost 2. It was not
+// trained by XGBoost.
+const xgbSoftprobModel = `{"learner":{"attributes":{},"feature_names":[],"feature_types":[],
+"gradient_booster":{"model":{"gbtree_model_param":{"num_parallel_tree":"1","num_trees":"6"},"iteration_indptr":[0,3,6],
+"tree_info":[0,1,2,0,1,2],"trees":[
+{"base_weights":[0.1,0.3,-0.2],"categories":[],"categories_nodes":[],"categories_segments":[],"categories_sizes":[],"default_left":[0,0,0],"id":0,"left_children":[1,-1,-1],"loss_changes":[2.5,0,0],"parents":[2147483647,0,0],"right_children":[2,-1,-1],"split_conditions":[0.5,0.3,-0.2],"split_indices":[0,0,0],"split_type":[0,0,0],"sum_hessian":[30,15,15],"tree_param":{"num_deleted":"0","num_feature":"3","num_nodes":"3","size_leaf_vector":"1"}},
+{"base_weights":[0,0.1,0.2,0.25,-0.3],"categories":[],"categories_nodes":[],"categories_segments":[],"categories_sizes":[],"default_left":[0,0,0,0,0],"id":1,"left_children":[1,-1,3,-1,-1],"loss_changes":[1.5,0,0.7,0,0],"parents":[2147483647,0,0,2,2],"right_children":[2,-1,4,-1,-1],"split_conditions":[-1.25,0.1,0.1,0.25,-0.3],"split_indices":[1,0,2,0,0],"split_type":[0,0,0,0,0],"sum_hessian":[30,10,20,10,10],"tree_param":{"num_deleted":"0","num_feature":"3","num_nodes":"5","size_leaf_vector":"1"}},
+{"base_weights":[0.05],"categories":[],"categories_nodes":[],"categories_segments":[],"categories_sizes":[],"default_left":[0],"id":2,"left_children":[-1],"loss_changes":[0],"parents":[2147483647],"right_children":[-1],"split_conditions":[0.05],"split_indices":[0],"split_type":[0],"sum_hessian":[30],"tree_param":{"num_deleted":"0","num_feature":"3","num_nodes":"1","size_leaf_vector":"1"}},
+{"base_weights":[0,-0.15,0.12],"categories":[],"categories_nodes":[],"categories_segments":[],"categories_sizes":[],"default_left":[0,0,0],"id":3,"left_children":[1,-1,-1],"loss_changes":[0.9,0,0],"parents":[2147483647,0,0],"right_children":[2,-1,-1],"split_conditions":[0.1,-0.15,0.12],"split_indices":[2,0,0],"split_type":[0,0,0],"sum_hessian":[30,12,18],"tree_param":{"num_deleted":"0","num_feature":"3","num_nodes":"3","size_leaf_vector":"1"}},
+{"base_weights":[0,0.2,-0.05],"categories":[],"categories_nodes":[],"categories_segments":[],"categories_sizes":[],"default_left":[0,0,0],"id":4,"left_children":[1,-1,-1],"loss_changes":[0.4,0,0],"parents":[2147483647,0,0],"right_children":[2,-1,-1],"split_conditions":[0.7,0.2,-0.05],"split_indices":[0,0,0],"split_type":[0,0,0],"sum_hessian":[30,20,10],"tree_param":{"num_deleted":"0","num_feature":"3","num_nodes":"3","size_leaf_vector":"1"}},
+{"base_weights":[0,0.3,-0.1],"categories":[],"categories_nodes":[],"categories_segments":[],"categories_sizes":[],"default_left":[0,0,0],"id":5,"left_children":[1,-1,-1],"loss_changes":[0.8,0,0],"parents":[2147483647,0,0],"right_children":[2,-1,-1],"split_conditions":[1.3333333,0.3,-0.1],"split_indices":[1,0,0],"split_type":[0,0,0],"sum_hessian":[30,20,10],"tree_param":{"num_deleted":"0","num_feature":"3","num_nodes":"3","size_leaf_vector":"1"}}
+]},"name":"gbtree"},
+"learner_model_param":{"base_score":"5E-1","boost_from_average":"1","num_class":"3","num_feature":"3","num_target":"1"},
+"objective":{"name":"multi:softprob","softmax_multiclass_param":{"num_class":"3"}}},"version":[2,0,3]}`
+
+// Converts a JSON document into UBJSON, writing the arrays of numbers as typed float32 arrays,
+// as XGBoost does.
+func jsonToUBJ(Te *testing.T, doc string) []byte {
+	var j any
+	if err := json.Unmarshal([]byte(doc), &j); err != nil {
+		Te.Fatal(err)
+	}
+	var conv func(v any) any
+	conv = func(v any) any {
+		switch v := v.(type) {
+		case map[string]any:
+			for k, e := range v {
+				v[k] = conv(e)
+			}
+		case []any:
+			nums := make([]float32, 0, len(v))
+			for i, e := range v {
+				v[i] = conv(e)
+				if f, ok := e.(float64); ok {
+					nums = append(nums, float32(f))
+				}
+			}
+			if len(nums) == len(v) && len(v) > 0 {
+				return nums
+			}
+		}
+		return v
+	}
+	b, err := utils.MarshalUBJSON(conv(j))
+	if err != nil {
+		Te.Fatal(err)
+	}
+	return b
+}
+
+// Samples for xgbSoftprobModel, and their expected margins, worked out by hand from the trees
+// following XGBoost's rules, which send samples with float32(x) < split condition to the left.
+// They are not checked against XGBoost itself.
+var xgbSoftprobMargins = []struct {
+	x      []float64
+	margin []float64
+}{
+	{[]float64{0, 0, 0}, []float64{0.65, 0.95, 0.85}},
+	{[]float64{0.5, -1.25, 0.1}, []float64{0.42, 0.4, 0.85}}, //at the split conditions: right
+	{[]float64{1, 2, -1}, []float64{0.15, 0.7, 0.45}},
+	{[]float64{float64(math.Nextafter32(0.5, 0)), -1.3, float64(math.Nextafter32(0.1, 0))}, []float64{0.65, 0.8, 0.85}},
+	{[]float64{math.Nextafter(0.5, 0), 1.3333333, 0.1}, []float64{0.42, 0.4, 0.45}}, //the features round up to the conditions in float32
+}
+
+func TestXGBoostImport(Te *testing.T) {
+	jm, err := ReadXGBoostJSON(strings.NewReader(xgbSoftprobModel))
+	if err != nil {
+		Te.Fatal(err)
+	}
+	um, err := ReadXGBoostUBJ(bytes.NewReader(jsonToUBJ(Te, xgbSoftprobModel)))
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if len(jm.b) != 2 || len(jm.ClassLabels()) != 3 || len(jm.b[0]) != 3 {
+		Te.Fatalf("Expected 2 rounds with 3 trees each, got %d rounds", len(jm.b))
+	}
+	if !slices.Equal(jm.BaseScores(), []float64{0.5, 0.5, 0.5}) || jm.b[0][2].value != 0.05 {
+		Te.Errorf("The base score should be kept apart from the trees: %v, %v", jm.BaseScores(), jm.b[0][2].value)
+	}
+	for _, s := range xgbSoftprobMargins {
+		for _, m := range []*MultiClass{jm, um} {
+			raw := m.PredictSingleRaw(s.x)
+			for k, r := range s.margin {
+				if math.Abs(r-raw[k]) > 1e-6 {
+					Te.Fatalf("Imported model margins %v (sample %v), expected: %v", raw, s.x, s.margin)
+				}
+			}
+		}
+	}
+	//a binary:logistic model, with a base score of 0.3 and all the trees for one class
+	bin := strings.Replace(xgbSoftprobModel, `"multi:softprob","softmax_multiclass_param":{"num_class":"3"}`, `"binary:logistic","reg_loss_param":{"scale_pos_weight":"1"}`, 1)
+	bin = strings.Replace(bin, `"base_score":"5E-1"`, `"base_score":"3E-1"`, 1)
+	bin = strings.Replace(bin, `"num_class":"3"`, `"num_class":"0"`, 1)
+	bin = strings.Replace(bin, `"tree_info":[0,1,2,0,1,2]`, `"tree_info":[0,0,0,0,0,0]`, 1)
+	bm, err := ReadXGBoostJSON(strings.NewReader(bin))
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if len(bm.b) != 6 || len(bm.ClassLabels()) != 2 {
+		Te.Fatalf("Expected a 2-class model with 6 rounds, got %d rounds and labels %v", len(bm.b), bm.ClassLabels())
+	}
+	for _, s := range xgbSoftprobMargins {
+		//the sum of all the trees, plus the base score
+		margin := math.Log(0.3/0.7) + s.margin[0] + s.margin[1] + s.margin[2] - 1.5
+		p := 1 / (1 + math.Exp(-margin))
+		if q := bm.PredictSingle(s.x)[1]; math.Abs(q-p) > 1e-6 {
+			Te.Fatalf("Imported binary model predicts %.7f, expected %.7f", q, p)
+		}
+	}
+	//the per-class base scores of the binary model survive serialization and export
+	var jbuf, xbuf bytes.Buffer
+	if err := WriteJSONModel(bm, &jbuf); err != nil {
+		Te.Fatal(err)
+	}
+	if err := WriteXGBoostJSON(bm, &xbuf); err != nil {
+		Te.Fatal(err)
+	}
+	rj, err := ReadJSONModel(&jbuf)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	rx, err := ReadXGBoostJSON(&xbuf)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	c := bm.Compile()
+	for _, s := range xgbSoftprobMargins {
+		p := bm.PredictSingle(s.x)
+		for _, q := range [][]float64{rj.PredictSingle(s.x), rx.PredictSingle(s.x), c.PredictSingle(s.x)} {
+			if math.Abs(p[1]-q[1]) > 1e-6 {
+				Te.Fatalf("Recovered binary model predicts %v, original %v", q, p)
+			}
+		}
+	}
+	//a DART model where the first tree has a weight of 0.
+	dart := strings.Replace(xgbSoftprobModel, `"gradient_booster":{"model":`, `"gradient_booster":{"name":"dart","weight_drop":[0,1,1,1,1,1],"gbtree":{"model":`, 1)
+	dart = strings.Replace(dart, `"name":"gbtree"},`, `"name":"gbtree"}},`, 1)
+	dm, err := ReadXGBoostJSON(strings.NewReader(dart))
+	if err != nil {
+		Te.Fatal(err)
+	}
+	for _, s := range xgbSoftprobMargins[:1] {
+		raw := dm.PredictSingleRaw(s.x)
+		if math.Abs(raw[0]-0.35) > 1e-6 || math.Abs(raw[1]-0.95) > 1e-6 {
+			Te.Fatalf("Imported DART model margins %v, expected: [0.35 0.95 0.85]", raw)
+		}
+	}
+}
+
+func TestXGBoostExport(Te *testing.T) {
+	data := synthData(200, 32)
+	test := synthData(200, 33)
+	for _, O := range []*Options{DefaultXOptions(), DefaultGOptions(), DefaultDARTOptions()} {
+		O.Rounds = 10
+		O.EarlyStop = 0
+		m := NewMultiClass(data, O)
+		var jbuf, ubuf bytes.Buffer
+		if err := WriteXGBoostJSON(m, &jbuf); err != nil {
+			Te.Fatal(err)
+		}
+		if err := WriteXGBoostUBJ(m, &ubuf); err != nil {
+			Te.Fatal(err)
+		}
+		jm, err := ReadXGBoostJSON(&jbuf)
+		if err != nil {
+			Te.Fatal(err)
+		}
+		um, err := ReadXGBoostUBJ(&ubuf)
+		if err != nil {
+			Te.Fatal(err)
+		}
+		for _, v := range test.Data {
+			p := m.PredictSingle(v)
+			for _, r := range []*MultiClass{jm, um} {
+				for k, q := range r.PredictSingle(v) {
+					if math.Abs(p[k]-q) > 1e-5 {
+						Te.Fatalf("Exported model (%s) predicts %v, original %v", O, r.PredictSingle(v), p)
+					}
+				}
+			}
+		}
+	}
+	ml := NewMultiLabel(synthMultiLabelData(100, 34))
+	var buf bytes.Buffer
+	if err := WriteXGBoostJSON(ml, &buf, 3); err != nil {
+		Te.Fatal(err)
+	}
+	if s := buf.String(); !strings.Contains(s, `"binary:logistic"`) || !strings.Contains(s, `"num_target":"3"`) || !strings.Contains(s, `"num_feature":"3"`) {
+		Te.Errorf("Unexpected multi-label XGBoost model")
+	}
+	cal, _ := ml.Calibrate(synthMultiLabelData(100, 35), "platt")
+	if err := WriteXGBoostJSON(cal, &buf); err == nil {
+		Te.Errorf("Exporting a calibrated model should fail")
+	}
+}
+
+// Trees for a small LightGBM text model.
+var lgbTestTrees = []string{`Tree=0
+num_leaves=3
+num_cat=0
+split_feature=0 1
+split_gain=10.5 3.25
+threshold=0.5 1.25
+decision_type=2 2
+left_child=1 -1
+right_child=-3 -2
+leaf_value=0.10000000000000001 0.20000000000000001 0.29999999999999999
+leaf_weight=10 10 10
+leaf_count=10 10 10
+internal_value=0 0.14999999999999999
+internal_weight=30 20
+internal_count=30 20
+is_linear=0
+shrinkage=1
+`, `Tree=1
+num_leaves=1
+num_cat=0
+split_feature=
+split_gain=
+threshold=
+decision_type=
+left_child=
+right_child=
+leaf_value=-0.050000000000000003
+leaf_weight=
+leaf_count=
+internal_value=
+internal_weight=
+internal_count=
+is_linear=0
+shrinkage=1
+`, `Tree=2
+num_leaves=2
+num_cat=0
+split_feature=2
+split_gain=4
+threshold=0
+decision_type=10
+left_child=-1
+right_child=-2
+leaf_value=0.40000000000000002 -0.40000000000000002
+leaf_weight=15 15
+leaf_count=15 15
+internal_value=0
+internal_weight=30
+internal_count=30
+is_linear=0
+shrinkage=1
+`, `Tree=3
+num_leaves=2
+num_cat=0
+split_feature=1
+split_gain=1
+threshold=-1
+decision_type=2
+left_child=-1
+right_child=-2
+leaf_value=0.01 0.02
+leaf_weight=15 15
+leaf_count=15 15
+internal_value=0
+internal_weight=30
+internal_count=30
+is_linear=0
+shrinkage=0.1
+`, `Tree=4
+num_leaves=1
+leaf_value=0.070000000000000007
+shrinkage=0.1
+`, `Tree=5
+num_leaves=1
+leaf_value=-0.029999999999999999
+shrinkage=0.1
+`}
+
+// Returns a LightGBM text model with the given header fields and trees.
+func lgbTestModel(header string, trees ...int) string {
+	s := "tree\nversion=v4\n" + header + "max_feature_idx=2\nfeature_names=Column_0 Column_1 Column_2\nfeature_infos=[-3:3] [-3:3] [-3:3]\ntree_sizes=1 1\n\n"
+	for _, t := range trees {
+		s += lgbTestTrees[t] + "\n\n"
+	}
+	return s + "end of trees\n\nfeature_importances:\nColumn_0=1\n\nparameters:\n[boosting: gbdt]\nend of parameters\n\npandas_categorical:null\n"
+}
+
+func TestLightGBMImport(Te *testing.T) {
+	points := [][]float64{{0.5, 1.25, 0}, {0.6, -2, 1}, {0, 2, -1}}
+	margins := [][]float64{{0.12, 0.02, 0.37}, {0.31, 0.02, -0.43}, {0.22, 0.02, 0.37}}
+	m, err := ReadLightGBM(strings.NewReader(lgbTestModel("num_class=3\nnum_tree_per_iteration=3\nlabel_index=0\nobjective=multiclass num_class:3\n", 0, 1, 2, 3, 4, 5)))
+	if err != nil {
+		Te.Fatal(err)
+	}
+	for i, v := range points {
+		raw := m.PredictSingleRaw(v)
+		for k, r := range raw {
+			if math.Abs(r-margins[i][k]) > 1e-12 {
+				Te.Fatalf("LightGBM multiclass model margins for %v: %v, expected %v", v, raw, margins[i])
+			}
+		}
+	}
+	b, err := ReadLightGBM(strings.NewReader(lgbTestModel("num_class=1\nnum_tree_per_iteration=1\nlabel_index=0\nobjective=binary sigmoid:2\n", 0, 3)))
+	if err != nil {
+		Te.Fatal(err)
+	}
+	for i, v := range points {
+		p := 1 / (1 + math.Exp(-2*margins[i][0]))
+		if q := b.PredictSingle(v)[1]; math.Abs(p-q) > 1e-12 {
+			Te.Fatalf("LightGBM binary model predicts %.6f, expected %.6f", q, p)
+		}
+	}
+	r, err := ReadLightGBMRegressor(strings.NewReader(lgbTestModel("num_class=1\nnum_tree_per_iteration=1\nlabel_index=0\nobjective=poisson\n", 0, 3)))
+	if err != nil {
+		Te.Fatal(err)
+	}
+	rf, err := ReadLightGBMRegressor(strings.NewReader(lgbTestModel("num_class=1\nnum_tree_per_iteration=1\nlabel_index=0\nobjective=regression\naverage_output\n", 0, 3)))
+	if err != nil {
+		Te.Fatal(err)
+	}
+	for i, v := range points {
+		if p := r.PredictSingle(v); math.Abs(p-math.Exp(margins[i][0])) > 1e-12 {
+			Te.Fatalf("LightGBM poisson model predicts %.6f, expected %.6f", p, math.Exp(margins[i][0]))
+		}
+		if p := rf.PredictSingle(v); math.Abs(p-margins[i][0]/2) > 1e-12 {
+			Te.Fatalf("LightGBM averaged model predicts %.6f, expected %.6f", p, margins[i][0]/2)
+		}
+	}
+	//the transformations LightGBM applies for a model fitted to the square root of the target,
+	//and for cross_entropy_lambda.
+	rs, err := ReadLightGBMRegressor(strings.NewReader(lgbTestModel("num_class=1\nnum_tree_per_iteration=1\nlabel_index=0\nobjective=regression sqrt\n", 0, 3)))
+	if err != nil {
+		Te.Fatal(err)
+	}
+	rl, err := ReadLightGBMRegressor(strings.NewReader(lgbTestModel("num_class=1\nnum_tree_per_iteration=1\nlabel_index=0\nobjective=cross_entropy_lambda\n", 0, 3)))
+	if err != nil {
+		Te.Fatal(err)
+	}
+	var js bytes.Buffer
+	if err := WriteJSONRegressor(rs, &js); err != nil {
+		Te.Fatal(err)
+	}
+	rj, err := ReadJSONRegressor(&js)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	for _, x := range []float64{-2, -0.3, 0, 0.7, 40, -40} {
+		sq, sp := x*x, math.Log1p(math.Exp(x))
+		if x < 0 {
+			sq = -sq
+		}
+		if math.IsInf(sp, 0) {
+			sp = x
+		}
+		if p := RegressorTransformMap["signsquare"](x); p != sq {
+			Te.Errorf("signsquare(%v) = %v, expected %v", x, p, sq)
+		}
+		if p := RegressorTransformMap["softplus"](x); math.Abs(p-sp) > 1e-12 {
+			Te.Errorf("softplus(%v) = %v, expected %v", x, p, sp)
+		}
+	}
+	for i, v := range points {
+		m := margins[i][0]
+		if p := rs.PredictSingle(v); math.Abs(p-m*math.Abs(m)) > 1e-12 || rj.PredictSingle(v) != p {
+			Te.Fatalf("LightGBM sqrt model predicts %.6f (%.6f after reading), expected %.6f", p, rj.PredictSingle(v), m*math.Abs(m))
+		}
+		if p := rl.PredictSingle(v); math.Abs(p-math.Log1p(math.Exp(m))) > 1e-12 {
+			Te.Fatalf("LightGBM cross_entropy_lambda model predicts %.6f, expected %.6f", p, math.Log1p(math.Exp(m)))
+		}
+	}
+	if _, err := ReadLightGBMRegressor(strings.NewReader(lgbTestModel("objective=poisson sqrt\n", 0))); err == nil {
+		Te.Errorf("Reading a poisson model with the sqrt argument should fail")
+	}
+	if _, err := ReadLightGBMRegressor(strings.NewReader(lgbTestModel("objective=binary sigmoid:1\n", 0))); err == nil {
+		Te.Errorf("Reading a classifier as a regressor should fail")
+	}
+	linear := strings.Replace(lgbTestModel("objective=regression\n", 0), "is_linear=0", "is_linear=1\nleaf_const=0.1 0.2 0.3\nleaf_features= 1  \nleaf_coeff= 0.5  ", 1)
+	if _, err := ReadLightGBMRegressor(strings.NewReader(linear)); err == nil {
+		Te.Errorf("Reading a model with linear trees should fail")
+	}
+}
+
+type protoField struct {
+	num, wiretype int
+	varint        uint64
+	data          []byte
+}
+
+// Decodes one protobuf message into its fields, without recursion.
+func decodeProto(Te *testing.T, b []byte) []protoField {
+	var ret []protoField
+	for len(b) > 0 {
+		k, n := binary.Uvarint(b)
+		b = b[n:]
+		f := protoField{num: int(k >> 3), wiretype: int(k & 7)}
+		switch f.wiretype {
+		case 0:
+			f.varint, n = binary.Uvarint(b)
+			b = b[n:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			f.data = b[n : n+int(l)]
+			b = b[n+int(l):]
+		case 5:
+			f.data = b[:4]
+			b = b[4:]
+		default:
+			Te.Fatalf("Unexpected wire type %d", f.wiretype)
+		}
+		ret = append(ret, f)
+	}
+	return ret
+}
+
+func protoSub(Te *testing.T, b []byte, num int) [][]byte {
+	var ret [][]byte
+	for _, f := range decodeProto(Te, b) {
+		if f.num == num {
+			ret = append(ret, f.data)
+		}
+	}
+	return ret
+}
+
+// Evaluates the TreeEnsembleClassifier node of an ONNX model on the sample v.
+func evalONNX(Te *testing.T, model []byte, v []float64) []float64 {
+	graph := protoSub(Te, model, 7)[0]
+	node := protoSub(Te, graph, 1)[0]
+	ints := map[string][]int{}
+	floats := map[string][]float64{}
+	strs := map[string][]string{}
+	for _, a := range protoSub(Te, node, 5) {
+		name := string(protoSub(Te, a, 1)[0])
+		for _, f := range decodeProto(Te, a) {
+			switch f.num {
+			case 7:
+				for i := 0; i < len(f.data); i += 4 {
+					floats[name] = append(floats[name], float64(math.Float32frombits(binary.LittleEndian.Uint32(f.data[i:]))))
+				}
+			case 8:
+				for d := f.data; len(d) > 0; {
+					x, n := binary.Uvarint(d)
+					ints[name] = append(ints[name], int(x))
+					d = d[n:]
+				}
+			case 4, 9:
+				strs[name] = append(strs[name], string(f.data))
+			}
+		}
+	}
+	type key struct{ t, n int }
+	idx := map[key]int{}
+	for i := range ints["nodes_nodeids"] {
+		idx[key{ints["nodes_treeids"][i], ints["nodes_nodeids"][i]}] = i
+	}
+	raw := slices.Clone(floats["base_values"])
+	for i, t := range ints["class_treeids"] {
+		//find the leaf for this tree, then add the weight if it's this one.
+		j := idx[key{t, 0}]
+		for strs["nodes_modes"][j] != "LEAF" {
+			next := ints["nodes_falsenodeids"][j]
+			if float32(v[ints["nodes_featureids"][j]]) <= float32(floats["nodes_values"][j]) {
+				next = ints["nodes_truenodeids"][j]
+			}
+			j = idx[key{t, next}]
+		}
+		if ints["nodes_nodeids"][j] == ints["class_nodeids"][i] {
+			raw[ints["class_ids"][i]] += floats["class_weights"][i]
+		}
+	}
+	switch strs["post_transform"][0] {
+	case "SOFTMAX":
+		return utils.SoftMax(raw, raw)
+	case "LOGISTIC":
+		for i, r := range raw {
+			raw[i] = 1 / (1 + math.Exp(-r))
+		}
+		return raw
+	}
+	Te.Fatalf("Unexpected post_transform %v", strs["post_transform"])
+	return nil
+}
+
+func TestONNXExport(Te *testing.T) {
+	data := synthData(200, 36)
+	test := synthData(100, 37)
+	O := DefaultXOptions()
+	O.Rounds = 10
+	O.EarlyStop = 0
+	mo := O.Clone()
+	mo.MultiOutput = true
+	for _, m := range []*MultiClass{NewMultiClass(data, O), NewMultiClass(data, mo), NewMultiLabel(synthMultiLabelData(100, 38))} {
+		var buf bytes.Buffer
+		if err := WriteONNX(m, &buf, 4); err != nil {
+			Te.Fatal(err)
+		}
+		model := buf.Bytes()
+		if s := string(model); !strings.Contains(s, "ai.onnx.ml") || !strings.Contains(s, "TreeEnsembleClassifier") {
+			Te.Errorf("Missing operator in the ONNX model")
+		}
+		for _, v := range test.Data {
+			p := m.PredictSingle(v)
+			q := evalONNX(Te, model, v)
+			for k := range p {
+				if math.Abs(p[k]-q[k]) > 1e-4 {
+					Te.Fatalf("ONNX model predicts %v, original %v", q, p)
+				}
+			}
+		}
+	}
+	if err := WriteONNX(NewMultiClass(data, DefaultGOptions()), &bytes.Buffer{}); err != nil {
+		Te.Error(err)
+	}
+}
+
+func TestPMML(Te *testing.T) {
+	data := synthData(200, 39)
+	test := synthData(100, 40)
+	mo := DefaultXOptions()
+	mo.MultiOutput = true
+	for _, O := range []*Options{DefaultXOptions(), DefaultGOptions(), DefaultDARTOptions(), mo} {
+		O.Rounds = 10
+		O.EarlyStop = 0
+		m := NewMultiClass(data, O)
+		var buf bytes.Buffer
+		if err := WritePMML(m, &buf, data.Keys...); err != nil {
+			Te.Fatal(err)
+		}
+		if s := buf.String(); !strings.Contains(s, `<DataField name="c" optype="continuous" dataType="double">`) || !strings.Contains(s, `normalizationMethod="softmax"`) {
+			Te.Errorf("Unexpected PMML document")
+		}
+		r, err := ReadPMML(&buf)
+		if err != nil {
+			Te.Fatal(err)
+		}
+		if !slices.Equal(r.BaseScores(), m.BaseScores()) {
+			Te.Errorf("PMML model base scores %v, original %v", r.BaseScores(), m.BaseScores())
+		}
+		for _, v := range test.Data {
+			p, q := m.PredictSingle(v), r.PredictSingle(v)
+			for k := range p {
+				if math.Abs(p[k]-q[k]) > 1e-9 {
+					Te.Fatalf("PMML model (%s) predicts %v, original %v", O, q, p)
+				}
+			}
+		}
+	}
+	//per-class base scores, as in some imported models
+	m := NewMultiClass(data, DefaultXOptions())
+	m.setBaseScores([]float64{0.1, 0.2, -0.3})
+	var buf bytes.Buffer
+	if err := WritePMML(m, &buf); err != nil {
+		Te.Fatal(err)
+	}
+	r, err := ReadPMML(&buf)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if !slices.Equal(r.BaseScores(), m.BaseScores()) {
+		Te.Errorf("PMML model with per-class base scores %v, original %v", r.BaseScores(), m.BaseScores())
+	}
+	if p, q := m.PredictSingle(test.Data[0]), r.PredictSingle(test.Data[0]); math.Abs(p[2]-q[2]) > 1e-9 {
+		Te.Errorf("PMML model with per-class base scores predicts %v, original %v", q, p)
+	}
+	ml := NewMultiLabel(synthMultiLabelData(100, 41))
+	if err := WritePMML(ml, &bytes.Buffer{}); err == nil {
+		Te.Errorf("Exporting a multi-label model to PMML should fail")
+	}
+}
+
+func TestJSONModel(Te *testing.T) {
+	data := synthData(200, 42)
+	test := synthData(100, 43)
+	mo := DefaultXOptions()
+	mo.MultiOutput = true
+	var models []*MultiClass
+	for _, O := range []*Options{DefaultXOptions(), DefaultGOptions(), DefaultDARTOptions(), mo} {
+		O.Rounds = 8
+		O.EarlyStop = 0
+		models = append(models, NewMultiClass(data, O))
+	}
+	cal, err := models[0].Calibrate(synthData(100, 44), "isotonic")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	models = append(models, cal, NewMultiLabel(synthMultiLabelData(100, 45)))
+	for i, m := range models {
+		var buf bytes.Buffer
+		if err := WriteJSONModel(m, &buf); err != nil {
+			Te.Fatal(err)
+		}
+		var doc map[string]any
+		if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+			Te.Fatalf("The model is not a valid JSON document: %v", err)
+		}
+		if doc["Version"] != float64(JSONModelVersion) || m.NFeatures() == 0 || doc["NFeatures"] != float64(m.NFeatures()) {
+			Te.Errorf("Unexpected model header %v %v", doc["Version"], doc["NFeatures"])
+		}
+		r, err := ReadJSONModel(&buf)
+		if err != nil {
+			Te.Fatal(err)
+		}
+		if i < 4 && (!slices.Equal(r.FeatureNames(), data.Keys) || r.Options().Rounds != 8 || r.Options().Loss == nil) {
+			Te.Errorf("Options or feature names not recovered: %v %v", r.FeatureNames(), r.Options())
+		}
+		for _, v := range test.Data {
+			p, q := m.PredictSingle(v), r.PredictSingle(v)
+			if !slices.Equal(p, q) {
+				Te.Fatalf("Model %d predicts %v after reading, %v before", i, q, p)
+			}
+		}
+	}
+	//The old format can still be read.
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if err := JSONMultiClass(models[0], "softmax", w); err != nil {
+		Te.Fatal(err)
+	}
+	w.Flush()
+	r, err := ReadJSONModel(&buf)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if p, q := models[0].PredictSingle(test.Data[0]), r.PredictSingle(test.Data[0]); !slices.Equal(p, q) {
+		Te.Errorf("Model in the old format predicts %v after reading, %v before", q, p)
+	}
+}
+
+func TestOptionsJSON(Te *testing.T) {
+	O := DefaultGOptions()
+	O.EarlyStop = 7
+	O.TreeMethod = "other"
+	if c := O.Clone(); c.EarlyStop != 7 || c.TreeMethod != "other" || !c.Equal(O) {
+		Te.Errorf("Options not fully cloned: %v", c)
+	}
+	for _, l := range []utils.LossFunc{&utils.SQErrLoss{}, &utils.MSELoss{}, &utils.HuberLoss{Delta: 0.7}, &utils.PseudoHuberLoss{Delta: 1.5}, &utils.QuantileLoss{Alpha: 0.9}} {
+		O.Loss = l
+		b, err := json.Marshal(O)
+		if err != nil {
+			Te.Fatal(err)
+		}
+		r := new(Options)
+		if err := json.Unmarshal(b, r); err != nil {
+			Te.Fatal(err)
+		}
+		if r.Loss == nil || r.Loss.Name() != l.Name() || fmt.Sprint(r.Loss) != fmt.Sprint(l) || r.EarlyStop != 7 {
+			Te.Errorf("Loss %s recovered as %v, %s", l.Name(), r.Loss, b)
+		}
+	}
+	r := new(Options)
+	if err := json.Unmarshal([]byte(`{"Rounds":3,"Loss":"unknown"}`), r); err != nil {
+		Te.Fatal(err)
+	}
+	if r.Loss != nil || r.LossName() != "unknown" || r.Rounds != 3 {
+		Te.Errorf("Unknown loss read as %v, %q", r.Loss, r.LossName())
+	}
+	//a model trained with a loss that is not in LossMap.
+	data := synthData(150, 52)
+	O = DefaultXOptions()
+	O.Rounds = 5
+	O.Loss = &customLoss{}
+	boosted := NewMultiClass(data, O)
+	var js bytes.Buffer
+	if err := WriteJSONModel(boosted, &js); err != nil {
+		Te.Fatal(err)
+	}
+	m, err := ReadJSONModel(&js)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	jtest := newjsonTester()
+	if err := JSONMultiClass(m, "softmax", jtest); err != nil {
+		Te.Fatal(err)
+	}
+	l, err := UnJSONMultiClass(bufio.NewReader(strings.NewReader(strings.Join(jtest.Str, ""))))
+	if err != nil {
+		Te.Fatal(err)
+	}
+	for _, r := range []*MultiClass{m, l} {
+		if r.Options().Loss != nil || r.Options().LossName() != "custom" {
+			Te.Errorf("Custom loss read as %v, %q", r.Options().Loss, r.Options().LossName())
+		}
+		for _, v := range data.Data {
+			if !slices.Equal(r.PredictSingle(v), boosted.PredictSingle(v)) {
+				Te.Fatalf("Model with a custom loss predicts %v after reading, %v before", r.PredictSingle(v), boosted.PredictSingle(v))
+			}
+		}
+	}
+}
+
+// A loss that is not in LossMap.
+type customLoss struct {
+	utils.SQErrLoss
+}
+
+func (c *customLoss) Name() string { return "custom" }
+
+func TestBinary(Te *testing.T) {
+	data := synthData(200, 46)
+	test := synthData(100, 47)
+	mo := DefaultXOptions()
+	mo.MultiOutput = true
+	var models []*MultiClass
+	for _, O := range []*Options{DefaultXOptions(), DefaultGOptions(), DefaultDARTOptions(), mo} {
+		O.Rounds = 8
+		O.EarlyStop = 0
+		models = append(models, NewMultiClass(data, O))
+	}
+	models = append(models, NewMultiLabel(synthMultiLabelData(100, 48)))
+	for i, m := range models {
+		b, err := m.MarshalBinary()
+		if err != nil {
+			Te.Fatal(err)
+		}
+		var js bytes.Buffer
+		WriteJSONModel(m, &js)
+		if len(b) >= js.Len() {
+			Te.Errorf("Binary model (%d bytes) not smaller than the JSON one (%d bytes)", len(b), js.Len())
+		}
+		r := &MultiClass{}
+		if err := r.UnmarshalBinary(b); err != nil {
+			Te.Fatal(err)
+		}
+		if !slices.Equal(r.FeatureNames(), m.FeatureNames()) || r.NFeatures() != m.NFeatures() {
+			Te.Errorf("Feature names or count not recovered")
+		}
+		for _, v := range test.Data {
+			p, q := m.PredictSingle(v), r.PredictSingle(v)
+			if !slices.Equal(p, q) {
+				Te.Fatalf("Model %d predicts %v after reading, %v before", i, q, p)
+			}
+		}
+		b[len(b)/2] ^= 0xff
+		if err := r.UnmarshalBinary(b); err == nil {
+			Te.Errorf("Corrupted model %d read without errors", i)
+		}
+	}
+	//streaming, with several models in the same stream
+	var buf bytes.Buffer
+	for _, m := range models[:2] {
+		if err := WriteBinary(m, &buf); err != nil {
+			Te.Fatal(err)
+		}
+	}
+	for _, m := range models[:2] {
+		r, err := ReadBinary(&buf)
+		if err != nil {
+			Te.Fatal(err)
+		}
+		if p, q := m.PredictSingle(test.Data[0]), r.PredictSingle(test.Data[0]); !slices.Equal(p, q) {
+			Te.Errorf("Streamed model predicts %v after reading, %v before", q, p)
+		}
+	}
+}
+
+// Corrupted lengths in a binary model must give an error, without panics
+// or allocating much more memory than the size of the model.
+func TestBinaryCorruption(Te *testing.T) {
+	O := DefaultXOptions()
+	O.Rounds = 3
+	O.EarlyStop = 0
+	good, err := NewMultiClass(synthData(100, 50), O).MarshalBinary()
+	if err != nil {
+		Te.Fatal(err)
+	}
+	read := func(b []byte) error {
+		defer func() {
+			if r := recover(); r != nil {
+				Te.Fatalf("Panic reading a corrupted model: %v", r)
+			}
+		}()
+		var mem0, mem1 runtime.MemStats
+		runtime.ReadMemStats(&mem0)
+		_, err := ReadBinary(bytes.NewReader(b))
+		runtime.ReadMemStats(&mem1)
+		if alloc := mem1.TotalAlloc - mem0.TotalAlloc; alloc > 64<<20 {
+			Te.Fatalf("Reading a corrupted model of %d bytes allocated %d bytes", len(b), alloc)
+		}
+		return err
+	}
+	//the length of the metadata, the number of rounds, the number of trees in the
+	//first round, and the number of nodes and outputs of the first tree.
+	metalen := int(binary.LittleEndian.Uint32(good[8:]))
+	for _, offset := range []int{8, 12 + metalen, 16 + metalen, 20 + metalen, 24 + metalen} {
+		for _, v := range []uint32{0, 1, binaryMaxLen / 8, binaryMaxLen, math.MaxUint32} {
+			b := slices.Clone(good)
+			if binary.LittleEndian.Uint32(b[offset:]) == v {
+				continue
+			}
+			binary.LittleEndian.PutUint32(b[offset:], v)
+			if read(b) == nil {
+				Te.Errorf("Model with the length at %d set to %d read without errors", offset, v)
+			}
+		}
+	}
+	//large values everywhere
+	for offset := 0; offset+4 <= len(good); offset++ {
+		b := slices.Clone(good)
+		binary.LittleEndian.PutUint32(b[offset:], binaryMaxLen/2+uint32(offset))
+		if read(b) == nil {
+			Te.Errorf("Model with the bytes at %d overwritten read without errors", offset)
+		}
+	}
+}
+
+func TestInputSchema(Te *testing.T) {
+	data := synthData(150, 49)
+	O := DefaultXOptions()
+	O.Rounds = 5
+	m := NewMultiClass(data, O)
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if err := JSONMultiClass(m, "softmax", w); err != nil {
+		Te.Fatal(err)
+	}
+	w.Flush()
+	r, err := UnJSONMultiClass(bufio.NewReader(&buf))
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if r.NFeatures() != 4 || !slices.Equal(r.FeatureNames(), data.Keys) || r.Options().Rounds != 5 || r.Options().Loss.Name() != "sqerr" {
+		Te.Errorf("Schema not recovered from the old format: %d %v %v", r.NFeatures(), r.FeatureNames(), r.Options())
+	}
+	if err := r.CheckData(data); err != nil {
+		Te.Error(err)
+	}
+	swapped := &utils.DataBunch{Data: data.Data, Keys: []string{"b", "a", "c", "d"}}
+	if err := r.CheckData(swapped); err == nil {
+		Te.Errorf("Data with swapped features accepted")
+	}
+	if err := r.CheckInput([]float64{1, 2, 3}); err == nil {
+		Te.Errorf("Sample with the wrong number of features accepted")
+	}
+	//extra features at the end are ignored
+	wide := append(slices.Clone(data.Data[0]), 100)
+	widekeys := &utils.DataBunch{Data: [][]float64{wide}, Keys: append(slices.Clone(data.Keys), "extra")}
+	if err := r.CheckData(widekeys); err != nil {
+		Te.Error(err)
+	}
+	c := r.Compile()
+	if p, err := r.PredictSingleErr(wide); err != nil || !slices.Equal(p, r.PredictSingle(data.Data[0])) {
+		Te.Errorf("A sample with an extra feature predicts %v (%v), expected %v", p, err, r.PredictSingle(data.Data[0]))
+	}
+	if p, err := c.PredictSingleErr(wide); err != nil || !slices.Equal(p, c.PredictSingle(data.Data[0])) {
+		Te.Errorf("A sample with an extra feature predicts %v (%v) with the compiled model", p, err)
+	}
+	short := [][]float64{data.Data[0], {1, 2, 3}}
+	if _, err := r.PredictSingleErr(short[1]); err == nil {
+		Te.Errorf("PredictSingleErr accepted a sample with too few features")
+	}
+	if _, err := r.PredictErr(short); err == nil {
+		Te.Errorf("PredictErr accepted a sample with too few features")
+	}
+	if _, err := c.PredictSingleErr(short[1]); err == nil {
+		Te.Errorf("The compiled model accepted a sample with too few features")
+	}
+	if _, err := c.PredictErr(short); err == nil {
+		Te.Errorf("The compiled model accepted data with too few features")
+	}
+	defer func() {
+		if p := recover(); p == nil || !strings.Contains(fmt.Sprint(p), "trained with 4") {
+			Te.Errorf("Expected a panic with a clear message, got %v", p)
+		}
+	}()
+	r.PredictSingle([]float64{1, 2, 3})
+}
+
+func TestSaveModel(Te *testing.T) {
+	data := synthData(150, 50)
+	O := DefaultXOptions()
+	O.Rounds = 5
+	m := NewMultiClass(data, O)
+	same := func(r *MultiClass, format string) {
+		for _, v := range data.Data[:20] {
+			if p, q := m.PredictSingle(v), r.PredictSingle(v); !slices.Equal(p, q) {
+				Te.Fatalf("Model (%s) predicts %v after reading, %v before", format, q, p)
+			}
+		}
+	}
+	dir := Te.TempDir()
+	for _, name := range []string{"model.json", "model.json.gz", "model.bin", "model.bin.gz"} {
+		filename := dir + "/" + name
+		if err := SaveModel(m, filename); err != nil {
+			Te.Fatal(err)
+		}
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			Te.Fatal(err)
+		}
+		if gz := b[0] == 0x1f && b[1] == 0x8b; gz != strings.HasSuffix(name, ".gz") {
+			Te.Errorf("Unexpected compression for %s", name)
+		}
+		r, err := LoadModel(filename)
+		if err != nil {
+			Te.Fatal(err)
+		}
+		same(r, name)
+	}
+	//a failed save leaves the existing file untouched, and no temporary files.
+	bad := *m
+	bad.baseScore = math.NaN() //can't be written to JSON
+	if err := SaveModel(&bad, dir+"/model.json"); err == nil {
+		Te.Errorf("Saving a model with a NaN base score should fail")
+	}
+	r, err := LoadModel(dir + "/model.json")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	same(r, "model.json after a failed save")
+	if files, _ := os.ReadDir(dir); len(files) != 4 {
+		Te.Errorf("Expected only the 4 saved models in the directory, found %d files", len(files))
+	}
+	var buf bytes.Buffer
+	if err := WriteModel(m, &buf, true); err != nil {
+		Te.Fatal(err)
+	}
+	r, err = ReadModel(&buf)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	same(r, "gzip stream")
+	text, err := m.MarshalText()
+	if err != nil {
+		Te.Fatal(err)
+	}
+	r = &MultiClass{}
+	if err := r.UnmarshalText(text); err != nil {
+		Te.Fatal(err)
+	}
+	same(r, "text")
+	type wrapper struct {
+		Name  string
+		Model *MultiClass
+	}
+	j, err := json.Marshal(&wrapper{"test", m})
+	if err != nil {
+		Te.Fatal(err)
+	}
+	w := &wrapper{}
+	if err := json.Unmarshal(j, w); err != nil {
+		Te.Fatal(err)
+	}
+	same(w.Model, "embedded JSON")
+}
+
+func TestRegressorJSON(Te *testing.T) {
+	data := synthClaimsData(200, 53)
+	O := DefaultXOptions()
+	O.Rounds = 10
+	O.EarlyStop = 0
+	G := DefaultGOptions()
+	for _, R := range []*Regressor{NewRegressor(data, &utils.PoissonObj{}, O), NewRegressor(data, &utils.HuberLoss{Delta: 1}, G)} {
+		var buf bytes.Buffer
+		if err := WriteJSONRegressor(R, &buf); err != nil {
+			Te.Fatal(err)
+		}
+		if _, err := ReadJSONModel(bytes.NewReader(buf.Bytes())); err == nil {
+			Te.Errorf("A regressor was read as a classifier")
+		}
+		r, err := ReadJSONRegressor(&buf)
+		if err != nil {
+			Te.Fatal(err)
+		}
+		if r.Objective() != R.Objective() || r.Rounds() != R.Rounds() {
+			Te.Errorf("Objective or rounds not recovered: %s %d", r.Objective(), r.Rounds())
+		}
+		for _, v := range data.Data {
+			if p, q := R.PredictSingle(v), r.PredictSingle(v); p != q {
+				Te.Fatalf("Regressor (%s) predicts %v after reading, %v before", R.Objective(), q, p)
+			}
+		}
+	}
+	sq := func(labels, raw []float64) ([]float64, []float64) {
+		g, h := make([]float64, len(raw)), make([]float64, len(raw))
+		for i := range raw {
+			g[i], h[i] = raw[i]-labels[i], 1
+		}
+		return g, h
+	}
+	custom := NewRegressor(data, utils.NewCustomObjective("custom", sq, nil, math.Sqrt), O)
+	if err := WriteJSONRegressor(custom, &bytes.Buffer{}); err == nil {
+		Te.Errorf("A regressor with a custom transformation was serialized")
+	}
+}
@@ -0,0 +1,306 @@
+package boo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A LightGBM model, as read from a model.txt file.
+type lgbModel struct {
+	header        map[string]string
+	trees         []map[string]string
+	objective     string
+	objectiveArgs map[string]string
+}
+
+// Reads a LightGBM text model.
+func readLGBModel(r io.Reader) (*lgbModel, error) {
+	ret := &lgbModel{header: make(map[string]string), objectiveArgs: make(map[string]string)}
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), 1024*1024*1024)
+	current := ret.header
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "end of trees" {
+			break
+		}
+		k, v, found := strings.Cut(line, "=")
+		if line == "average_output" {
+			found = true //a flag without value
+		}
+		if !found {
+			continue
+		}
+		if k == "Tree" {
+			current = make(map[string]string)
+			ret.trees = append(ret.trees, current)
+			continue
+		}
+		current[k] = v
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(ret.trees) == 0 {
+		return nil, fmt.Errorf("No trees found in LightGBM model")
+	}
+	obj := strings.Fields(ret.header["objective"])
+	if len(obj) == 0 {
+		return nil, fmt.Errorf("LightGBM model without objective")
+	}
+	ret.objective = obj[0]
+	for _, a := range obj[1:] {
+		k, v, _ := strings.Cut(a, ":")
+		ret.objectiveArgs[k] = v
+	}
+	return ret, nil
+}
+
+// Returns the value of the header field with the given name as an int, or def if it is absent.
+func (L *lgbModel) headerInt(name string, def int) (int, error) {
+	v, ok := L.header[name]
+	if !ok {
+		return def, nil
+	}
+	return strconv.Atoi(v)
+}
+
+// Returns the scale factor for the raw predictions given by the "sigmoid"
+// argument of the objective (1 if absent).
+func (L *lgbModel) sigmoid() (float64, error) {
+	v, ok := L.objectiveArgs["sigmoid"]
+	if !ok {
+		return 1, nil
+	}
+	return strconv.ParseFloat(v, 64)
+}
+
+// Returns the factor by which the sum of the trees is multiplied: 1, or 1/(number of
+// iterations) for models that average their output (random forests).
+func (L *lgbModel) learningRate(treesPerIteration int) float64 {
+	if _, ok := L.header["average_output"]; ok {
+		return float64(treesPerIteration) / float64(len(L.trees))
+	}
+	return 1
+}
+
+// Parses a space-separated list of numbers.
+func lgbFloats(s string) ([]float64, error) {
+	f := strings.Fields(s)
+	ret := make([]float64, len(f))
+	var err error
+	for i, v := range f {
+		if ret[i], err = strconv.ParseFloat(v, 64); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// Parses a space-separated list of integers.
+func lgbInts(s string) ([]int, error) {
+	f := strings.Fields(s)
+	ret := make([]int, len(f))
+	var err error
+	for i, v := range f {
+		if ret[i], err = strconv.Atoi(v); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// Builds a boo tree from a LightGBM tree, with the leaf values multiplied by scale.
+func lgbTree(t map[string]string, scale float64) (*Tree, error) {
+	if t["is_linear"] == "1" {
+		//the leaves are linear models (leaf_const, leaf_coeff, leaf_features), not constants.
+		return nil, fmt.Errorf("Linear trees are not supported")
+	}
+	nleaves, err := strconv.Atoi(t["num_leaves"])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid number of leaves: %v", err)
+	}
+	leafValues, err := lgbFloats(t["leaf_value"])
+	if err != nil || len(leafValues) != nleaves {
+		return nil, fmt.Errorf("Invalid leaf values %q", t["leaf_value"])
+	}
+	leafCounts, _ := lgbInts(t["leaf_count"])
+	leaf := func(i int) *Tree {
+		ret := &Tree{xgb: true, branches: 1, value: leafValues[i] * scale}
+		if len(leafCounts) == nleaves {
+			ret.nsamples = leafCounts[i]
+		}
+		return ret
+	}
+	if nleaves == 1 {
+		return leaf(0), nil
+	}
+	n := nleaves - 1
+	var features, decision, left, right, counts []int
+	var thresholds, gains, internal []float64
+	for _, f := range []struct {
+		key string
+		ptr *[]int
+	}{{"split_feature", &features}, {"decision_type", &decision}, {"left_child", &left}, {"right_child", &right}} {
+		if *f.ptr, err = lgbInts(t[f.key]); err != nil || len(*f.ptr) != n {
+			return nil, fmt.Errorf("Invalid %s %q", f.key, t[f.key])
+		}
+	}
+	if thresholds, err = lgbFloats(t["threshold"]); err != nil || len(thresholds) != n {
+		return nil, fmt.Errorf("Invalid thresholds %q", t["threshold"])
+	}
+	gains, _ = lgbFloats(t["split_gain"])
+	internal, _ = lgbFloats(t["internal_value"])
+	counts, _ = lgbInts(t["internal_count"])
+	var build func(i, depth int) (*Tree, error)
+	build = func(i, depth int) (*Tree, error) {
+		if i < 0 {
+			if ^i >= nleaves {
+				return nil, fmt.Errorf("Invalid leaf %d", ^i)
+			}
+			return leaf(^i), nil
+		}
+		if i >= n || depth > n {
+			return nil, fmt.Errorf("Invalid node %d", i)
+		}
+		if decision[i]&1 != 0 {
+			return nil, fmt.Errorf("Categorical splits are not supported")
+		}
+		if (decision[i]>>2)&3 == 1 {
+			return nil, fmt.Errorf("Splits that treat zeros as missing values are not supported")
+		}
+		ret := &Tree{xgb: true, branches: 1, splitFeatureIndex: features[i], threshold: thresholds[i]}
+		ret.bestScoreSoFar = math.SmallestNonzeroFloat64 //any non-zero value marks the node as a split
+		if len(gains) == n && gains[i] != 0 {
+			ret.bestScoreSoFar = gains[i]
+		}
+		if len(internal) == n {
+			ret.value = internal[i] * scale
+		}
+		if len(counts) == n {
+			ret.nsamples = counts[i]
+		}
+		if ret.left, err = build(left[i], depth+1); err != nil {
+			return nil, err
+		}
+		if ret.right, err = build(right[i], depth+1); err != nil {
+			return nil, err
+		}
+		ret.branches += ret.left.branches + ret.right.branches
+		return ret, nil
+	}
+	return build(0, 0)
+}
+
+// Reads a classification model in LightGBM's text format (model.txt) and returns it as a
+// MultiClass. The multiclass, multiclassova and binary objectives are supported. Binary
+// models are converted into 2-class ones, where the probability of the class 1 is the
+// one given by LightGBM. For multiclassova models, the classes' probabilities
+// are independent (sigmoid) as in LightGBM. Categorical splits, linear trees, and splits that
+// treat zeros as missing values, are not supported, nor are missing values (NaN) in the data.
+func ReadLightGBM(r io.Reader) (*MultiClass, error) {
+	L, err := readLGBModel(r)
+	if err != nil {
+		return nil, err
+	}
+	sigmoid, err := L.sigmoid()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid sigmoid parameter: %v", err)
+	}
+	nclass, err := L.headerInt("num_class", 1)
+	if err != nil {
+		return nil, err
+	}
+	activation := "softmax"
+	binary := false
+	scale := 1.0
+	switch L.objective {
+	case "multiclass":
+	case "multiclassova":
+		activation = "sigmoid"
+		scale = sigmoid
+	case "binary":
+		binary = true
+		scale = sigmoid
+		nclass = 2
+	default:
+		return nil, fmt.Errorf("Unsupported LightGBM objective for classification: %s", L.objective)
+	}
+	perIteration := nclass
+	if binary {
+		perIteration = 1
+	}
+	if len(L.trees)%perIteration != 0 {
+		return nil, fmt.Errorf("%d trees for %d trees per iteration", len(L.trees), perIteration)
+	}
+	b := make([][]*Tree, 0, len(L.trees)/perIteration)
+	for i := 0; i < len(L.trees); i += perIteration {
+		round := make([]*Tree, 0, nclass)
+		if binary {
+			round = append(round, constantTree(0))
+		}
+		for j := i; j < i+perIteration; j++ {
+			tree, err := lgbTree(L.trees[j], scale)
+			if err != nil {
+				return nil, fmt.Errorf("Error in tree %d: %v", j, err)
+			}
+			round = append(round, tree)
+		}
+		b = append(b, round)
+	}
+	labels := make([]int, nclass)
+	for i := range labels {
+		labels[i] = i
+	}
+	ret := &MultiClass{b: b, learningRate: L.learningRate(perIteration), probTransform: ProbTransformMap[activation], probTransformName: activation, classLabels: labels, baseScore: 0, xgb: true}
+	if n, err := strconv.Atoi(L.header["max_feature_idx"]); err == nil {
+		ret.nfeatures = n + 1
+		if names := strings.Fields(L.header["feature_names"]); len(names) == ret.nfeatures {
+			ret.keys = names
+		}
+	}
+	return ret, nil
+}
+
+// Reads a regression model in LightGBM's text format (model.txt) and returns it as a
+// Regressor. The transformation of the raw predictions is the one corresponding to the
+// objective: exp for the poisson, gamma and tweedie objectives, a sigmoid for cross_entropy,
+// log(1+exp(x)) for cross_entropy_lambda, sign(x)*x² for objectives fitted to the square root
+// of the target (the sqrt argument) and none for the rest. The same limitations as in
+// ReadLightGBM apply.
+func ReadLightGBMRegressor(r io.Reader) (*Regressor, error) {
+	L, err := readLGBModel(r)
+	if err != nil {
+		return nil, err
+	}
+	transform := "identity"
+	switch L.objective {
+	case "multiclass", "multiclassova", "binary", "lambdarank", "rank_xendcg":
+		return nil, fmt.Errorf("LightGBM objective %s is not a regression one", L.objective)
+	case "poisson", "gamma", "tweedie":
+		transform = "exp"
+	case "cross_entropy", "xentropy":
+		transform = "sigmoid"
+	case "cross_entropy_lambda", "xentlambda":
+		transform = "softplus"
+	}
+	if _, ok := L.objectiveArgs["sqrt"]; ok {
+		if transform != "identity" {
+			return nil, fmt.Errorf("The sqrt argument is not supported for the LightGBM objective %s", L.objective)
+		}
+		transform = "signsquare"
+	}
+	trees := make([]*Tree, 0, len(L.trees))
+	for i, t := range L.trees {
+		tree, err := lgbTree(t, 1)
+		if err != nil {
+			return nil, fmt.Errorf("Error in tree %d: %v", i, err)
+		}
+		trees = append(trees, tree)
+	}
+	return &Regressor{b: trees, learningRate: L.learningRate(1), baseScore: 0, xgb: true, objective: "lightgbm:" + L.objective, transform: RegressorTransformMap[transform], transformName: transform}, nil
+}
@@ -0,0 +1,308 @@
+package boo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/rmera/boo/utils"
+)
+
+// The current version of the single-document JSON model format.
+const JSONModelVersion = 2
+
+// A boo ensemble as a single JSON document (the version 2 format).
+type JSONModel struct {
+	Format         string //always "boo"
+	Version        int
+	Kind           string   `json:",omitempty"` //"regressor" for Regressors, empty for MultiClass ensembles
+	FeatureNames   []string `json:",omitempty"`
+	NFeatures      int
+	Options        *Options `json:",omitempty"` //the options used for training, if known
+	Objective      string   `json:",omitempty"` //the name of the training loss, if known
+	Activation     string   //for Regressors, a key of RegressorTransformMap
+	LearningRate   float64
+	BaseScore      float64
+	BaseScores     []float64 `json:",omitempty"` //per-class base scores, which replace BaseScore. Only for some imported models.
+	XGB            bool
+	ClassLabels    []int
+	TreeWeights    [][]float64        `json:",omitempty"` //only for DART ensembles
+	OOBLoss        []float64          `json:",omitempty"`
+	OOBImprovement []float64          `json:",omitempty"`
+	Calibration    *utils.Calibration `json:",omitempty"`
+	Trees          [][]*JSONTree      //Trees[round][class]. Vector-leaf ensembles and Regressors have one tree per round.
+}
+
+// A tree node in the version 2 JSON format. Leaves have no children.
+type JSONTree struct {
+	Feature   int
+	Threshold float64
+	Gain      float64 `json:",omitempty"`
+	Samples   int     `json:",omitempty"`
+	Value     float64
+	Values    []float64 `json:",omitempty"` //only for vector-leaf trees
+	Left      *JSONTree `json:",omitempty"`
+	Right     *JSONTree `json:",omitempty"`
+}
+
+// Returns the version 2 JSON representation of the tree T.
+func (T *Tree) jsonTree() *JSONTree {
+	ret := &JSONTree{Samples: T.nsamples, Value: T.value, Values: T.values}
+	if T.Leaf() {
+		return ret
+	}
+	ret.Feature = T.splitFeatureIndex
+	ret.Threshold = T.threshold
+	ret.Gain = T.bestScoreSoFar
+	ret.Left = T.left.jsonTree()
+	ret.Right = T.right.jsonTree()
+	return ret
+}
+
+// Returns the tree represented by j.
+func (j *JSONTree) tree(xgb bool) (*Tree, error) {
+	ret := &Tree{xgb: xgb, value: j.Value, values: j.Values, outs: len(j.Values), nsamples: j.Samples, branches: 1}
+	if j.Left == nil && j.Right == nil {
+		if !xgb {
+			ret.bestScoreSoFar = math.Inf(1)
+		}
+		return ret, nil
+	}
+	if j.Left == nil || j.Right == nil {
+		return nil, fmt.Errorf("Split node with only one child")
+	}
+	ret.splitFeatureIndex = j.Feature
+	ret.threshold = j.Threshold
+	ret.bestScoreSoFar = j.Gain
+	if xgb && j.Gain == 0 {
+		ret.bestScoreSoFar = math.SmallestNonzeroFloat64 //any non-zero value marks the node as a split
+	}
+	var err error
+	if ret.left, err = j.Left.tree(xgb); err != nil {
+		return nil, err
+	}
+	if ret.right, err = j.Right.tree(xgb); err != nil {
+		return nil, err
+	}
+	ret.branches += ret.left.branches + ret.right.branches
+	ret.outs = ret.left.outs
+	return ret, nil
+}
+
+// Returns the version 2 JSON representation of the ensemble M.
+func (M *MultiClass) JSONModel() *JSONModel {
+	ret := M.jsonMetaData()
+	for _, round := range M.b {
+		r := make([]*JSONTree, 0, len(round))
+		for _, t := range round {
+			r = append(r, t.jsonTree())
+		}
+		ret.Trees = append(ret.Trees, r)
+	}
+	return ret
+}
+
+// Returns the version 2 JSON representation of the ensemble M, without the trees.
+func (M *MultiClass) jsonMetaData() *JSONModel {
+	ret := &JSONModel{
+		Format:         "boo",
+		Version:        JSONModelVersion,
+		FeatureNames:   M.keys,
+		NFeatures:      M.nfeatures,
+		Options:        M.options,
+		Activation:     M.probTransformName,
+		LearningRate:   M.learningRate,
+		BaseScore:      M.baseScore,
+		BaseScores:     M.baseScores,
+		XGB:            M.xgb,
+		ClassLabels:    M.classLabels,
+		TreeWeights:    M.weights,
+		OOBLoss:        M.oobLoss,
+		OOBImprovement: M.oobImprovement,
+		Calibration:    M.calibration,
+	}
+	if M.options != nil {
+		ret.Objective = M.options.LossName()
+	}
+	return ret
+}
+
+// Returns the ensemble represented by j.
+func (j *JSONModel) MultiClass() (*MultiClass, error) {
+	ret, err := j.metaData()
+	if err != nil {
+		return nil, err
+	}
+	if len(j.Trees) == 0 {
+		return nil, fmt.Errorf("Model without trees")
+	}
+	for r, round := range j.Trees {
+		trees := make([]*Tree, 0, len(round))
+		for c, jt := range round {
+			if jt == nil {
+				return nil, fmt.Errorf("Missing tree for round %d, class %d", r, c)
+			}
+			t, err := jt.tree(j.XGB)
+			if err != nil {
+				return nil, fmt.Errorf("Error reading tree for round %d, class %d: %v", r, c, err)
+			}
+			trees = append(trees, t)
+		}
+		ret.b = append(ret.b, trees)
+	}
+	return ret, nil
+}
+
+// Returns an ensemble with the data in j, but without trees.
+func (j *JSONModel) metaData() (*MultiClass, error) {
+	if j.Format != "boo" {
+		return nil, fmt.Errorf("Not a boo model, format: %q", j.Format)
+	}
+	if j.Version < 2 || j.Version > JSONModelVersion {
+		return nil, fmt.Errorf("Unsupported model version: %d", j.Version)
+	}
+	if j.Kind != "" {
+		return nil, fmt.Errorf("The model is a %s, not a classifier", j.Kind)
+	}
+	transform, ok := ProbTransformMap[j.Activation]
+	if !ok {
+		return nil, fmt.Errorf("Unknown activation function: %q", j.Activation)
+	}
+	if j.BaseScores != nil && len(j.BaseScores) != len(j.ClassLabels) {
+		return nil, fmt.Errorf("%d base scores for %d classes", len(j.BaseScores), len(j.ClassLabels))
+	}
+	ret := &MultiClass{
+		learningRate:      j.LearningRate,
+		classLabels:       j.ClassLabels,
+		probTransform:     transform,
+		probTransformName: j.Activation,
+		baseScore:         j.BaseScore,
+		baseScores:        j.BaseScores,
+		xgb:               j.XGB,
+		weights:           j.TreeWeights,
+		oobLoss:           j.OOBLoss,
+		oobImprovement:    j.OOBImprovement,
+		calibration:       j.Calibration,
+		options:           j.Options,
+		keys:              j.FeatureNames,
+		nfeatures:         j.NFeatures,
+	}
+	return ret, nil
+}
+
+// Writes the ensemble M to w as a single, indented JSON document (the version 2 format).
+func WriteJSONModel(M *MultiClass, w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	return enc.Encode(M.JSONModel())
+}
+
+// Reads an ensemble from r, in either the version 2 JSON format, or the older, line-based,
+// format written by JSONMultiClass.
+func ReadJSONModel(r io.Reader) (*MultiClass, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(b) {
+		//The old format is not a single JSON document.
+		return UnJSONMultiClass(bufio.NewReader(bytes.NewReader(b)))
+	}
+	j := &JSONModel{}
+	if err := json.Unmarshal(b, j); err != nil {
+		return nil, fmt.Errorf("Error unmarshalling model: %v", err)
+	}
+	return j.MultiClass()
+}
+
+// Returns the version 2 JSON representation of the regressor R. The Activation is empty
+// if R uses a custom transformation, which can't be serialized.
+func (R *Regressor) JSONModel() *JSONModel {
+	ret := &JSONModel{
+		Format:       "boo",
+		Version:      JSONModelVersion,
+		Kind:         "regressor",
+		Objective:    R.objective,
+		Activation:   R.transformName,
+		LearningRate: R.learningRate,
+		BaseScore:    R.baseScore,
+		XGB:          R.xgb,
+	}
+	for _, t := range R.b {
+		ret.Trees = append(ret.Trees, []*JSONTree{t.jsonTree()})
+	}
+	return ret
+}
+
+// Returns the regressor represented by j.
+func (j *JSONModel) Regressor() (*Regressor, error) {
+	if j.Format != "boo" || j.Kind != "regressor" {
+		return nil, fmt.Errorf("Not a boo regressor, format: %q, kind: %q", j.Format, j.Kind)
+	}
+	if j.Version < 2 || j.Version > JSONModelVersion {
+		return nil, fmt.Errorf("Unsupported model version: %d", j.Version)
+	}
+	transform, ok := RegressorTransformMap[j.Activation]
+	if !ok {
+		return nil, fmt.Errorf("Unknown transformation: %q", j.Activation)
+	}
+	ret := &Regressor{learningRate: j.LearningRate, baseScore: j.BaseScore, xgb: j.XGB, objective: j.Objective, transform: transform, transformName: j.Activation}
+	for r, round := range j.Trees {
+		if len(round) != 1 || round[0] == nil {
+			return nil, fmt.Errorf("Round %d doesn't have exactly one tree", r)
+		}
+		t, err := round[0].tree(j.XGB)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading tree for round %d: %v", r, err)
+		}
+		ret.b = append(ret.b, t)
+	}
+	return ret, nil
+}
+
+// Writes the regressor R to w as a single, indented JSON document (the version 2 format).
+// Regressors with custom transformations can't be written.
+func WriteJSONRegressor(R *Regressor, w io.Writer) error {
+	j := R.JSONModel()
+	if j.Activation == "" {
+		return fmt.Errorf("Regressors with custom transformations can't be serialized")
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	return enc.Encode(j)
+}
+
+// Reads a regressor in the version 2 JSON format from r.
+func ReadJSONRegressor(r io.Reader) (*Regressor, error) {
+	j := &JSONModel{}
+	if err := json.NewDecoder(r).Decode(j); err != nil {
+		return nil, fmt.Errorf("Error unmarshalling model: %v", err)
+	}
+	return j.Regressor()
+}
+
+// Implements json.Marshaler, using the version 2 JSON format.
+func (R *Regressor) MarshalJSON() ([]byte, error) {
+	j := R.JSONModel()
+	if j.Activation == "" {
+		return nil, fmt.Errorf("Regressors with custom transformations can't be serialized")
+	}
+	return json.Marshal(j)
+}
+
+// Implements json.Unmarshaler, for regressors in the version 2 JSON format.
+func (R *Regressor) UnmarshalJSON(b []byte) error {
+	j := &JSONModel{}
+	if err := json.Unmarshal(b, j); err != nil {
+		return err
+	}
+	ret, err := j.Regressor()
+	if err != nil {
+		return err
+	}
+	*R = *ret
+	return nil
+}
@@ -5,6 +5,9 @@ package boo
 
 import (
 	"fmt"
+	"runtime"
+	"slices"
+	"sync"
 
 	"github.com/rmera/boo/utils"
 	"gonum.org/v1/gonum/mat"
@@ -13,14 +16,23 @@ import (
 // MultiClass is a multi-class gradient-boosted (xgboost or "regular")
 // classification ensemble.
 type MultiClass struct {
-	b             [][]*Tree
-	learningRate  float64
-	classLabels   []int
-	probTransform func(*mat.Dense, *mat.Dense) *mat.Dense
-	tmp           []float64
-	predtmp       []float64
-	baseScore     float64
-	xgb           bool
+	b                 [][]*Tree
+	learningRate      float64
+	classLabels       []int
+	probTransform     func(*mat.Dense, *mat.Dense) *mat.Dense
+	probTransformName string
+	tmp               []float64
+	predtmp           []float64
+	baseScore         float64
+	baseScores        []float64 //per-class base scores, which replace baseScore if not nil
+	xgb               bool
+	weights           [][]float64 //per-tree weights, only for DART ensembles
+	oobLoss           []float64
+	oobImprovement    []float64
+	calibration       *utils.Calibration
+	options           *Options //the options used in the training, if known
+	keys              []string //the names of the features, if known
+	nfeatures         int      //the number of features of the training data, if known
 }
 
 func (M *MultiClass) ClassLabels() []int {
@@ -29,6 +41,114 @@ func (M *MultiClass) ClassLabels() []int {
 	return r
 }
 
+// Returns the base score (the raw prediction before adding any tree) for each class.
+// They are all the same, except for some imported models.
+func (M *MultiClass) BaseScores() []float64 {
+	if M.baseScores != nil {
+		return slices.Clone(M.baseScores)
+	}
+	ret := make([]float64, len(M.classLabels))
+	for i := range ret {
+		ret[i] = M.baseScore
+	}
+	return ret
+}
+
+// Sets the base score of each class. If they are all equal, a single base score is used.
+func (M *MultiClass) setBaseScores(scores []float64) {
+	M.baseScore, M.baseScores = 0, nil
+	if len(scores) == 0 {
+		return
+	}
+	M.baseScore = scores[0]
+	for _, v := range scores {
+		if v != scores[0] {
+			M.baseScores = slices.Clone(scores)
+			return
+		}
+	}
+}
+
+// Returns a copy of the options used to train the ensemble, or nil if they are not known
+// (for instance, for imported models).
+func (M *MultiClass) Options() *Options {
+	if M.options == nil {
+		return nil
+	}
+	return M.options.Clone()
+}
+
+// Returns the names of the features of the training data, if known.
+func (M *MultiClass) FeatureNames() []string {
+	return slices.Clone(M.keys)
+}
+
+// Returns the number of features of the training data, or 0 if it is not known.
+func (M *MultiClass) NFeatures() int {
+	return M.nfeatures
+}
+
+// Returns an error if the sample has fewer features than the training data. Extra features,
+// at the end of the sample, are ignored. If the number of features of the training data is
+// not known (as in models read from older files) no error is returned.
+func (M *MultiClass) CheckInput(instance []float64) error {
+	return checkInput(instance, M.nfeatures)
+}
+
+func checkInput(instance []float64, nfeatures int) error {
+	if len(instance) < nfeatures {
+		return fmt.Errorf("The sample has %d features, but the ensemble was trained with %d", len(instance), nfeatures)
+	}
+	return nil
+}
+
+func checkRows(data [][]float64, nfeatures int) error {
+	for i, v := range data {
+		if err := checkInput(v, nfeatures); err != nil {
+			return fmt.Errorf("Sample %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// Returns an error if any sample in D has fewer features than the training data or if the
+// Keys of D (if any) don't start with the feature names of the training data, in the same order.
+func (M *MultiClass) CheckData(D *utils.DataBunch) error {
+	if err := checkRows(D.Data, M.nfeatures); err != nil {
+		return err
+	}
+	if len(D.Keys) == 0 || len(M.keys) == 0 {
+		return nil
+	}
+	if len(D.Keys) < len(M.keys) {
+		return fmt.Errorf("The data has %d feature names, but the ensemble was trained with %d", len(D.Keys), len(M.keys))
+	}
+	for i, k := range D.Keys[:len(M.keys)] {
+		if k != M.keys[i] {
+			return fmt.Errorf("Feature %d is %q in the data, but %q in the ensemble", i, k, M.keys[i])
+		}
+	}
+	return nil
+}
+
+// Stores the training options and the feature names and count of the training data.
+func (M *MultiClass) setSchema(D *utils.DataBunch, O *Options) *MultiClass {
+	if O != nil {
+		M.options = O.Clone()
+	}
+	M.keys = slices.Clone(D.Keys)
+	if len(D.Data) > 0 {
+		M.nfeatures = len(D.Data[0])
+	}
+	return M
+}
+
+// Returns the name of the activation function of the ensemble (a key
+// of ProbTransformMap), or an empty string if it is unknown.
+func (M *MultiClass) Activation() string {
+	return M.probTransformName
+}
+
 // Returns the percentage of accuracy of the model on the data (which needs to contain
 // labels). You can give it the number of classes present, which helps with memory.
 func (M *MultiClass) Accuracy(D *utils.DataBunch, classes ...int) float64 {
@@ -87,24 +207,292 @@ func (M *MultiClass) PredictSingleClass(instance []float64, predictions ...[]flo
 }
 
 // Returns a slice with the probability of the sample belonging to each class. You can supply
-// a slice to be filled with the predictions in order to avoid allocation.
+// a slice to be filled with the predictions in order to avoid allocation. Panics if the sample
+// has fewer features than the training data, see PredictSingleErr.
 func (M *MultiClass) PredictSingle(instance []float64, predictions ...[]float64) []float64 {
 	var preds []float64
-	preds = make([]float64, len(M.b[0]))
-	tmp := make([]float64, len(M.b[0]))
-	for i := range tmp {
-		tmp[i] = M.baseScore
+	if len(predictions) > 0 && len(predictions[0]) >= len(M.classLabels) {
+		preds = predictions[0][:len(M.classLabels)]
+	} else {
+		preds = make([]float64, len(M.classLabels))
 	}
-	for _, ensemble := range M.b {
+	preds = M.rawSingle(instance, preds)
+	preds = M.activate(preds)
+	if M.calibration != nil {
+		preds = M.calibration.Apply(preds)
+	}
+	return preds
+}
+
+// Same as PredictSingle, but returns an error, instead of panicking, if the sample has fewer
+// features than the training data.
+func (M *MultiClass) PredictSingleErr(instance []float64, predictions ...[]float64) ([]float64, error) {
+	if err := M.CheckInput(instance); err != nil {
+		return nil, err
+	}
+	return M.PredictSingle(instance, predictions...), nil
+}
+
+// Fills raw with the raw predictions (before the activation function) of the ensemble for
+// the instance, and returns it.
+func (M *MultiClass) rawSingle(instance []float64, raw []float64) []float64 {
+	return M.rawRange(instance, raw, 0, len(M.b))
+}
+
+// Same as rawSingle, but only the rounds from first to last-1 are used. Panics if
+// the instance has fewer features than the training data.
+func (M *MultiClass) rawRange(instance []float64, raw []float64, first, last int) []float64 {
+	if err := M.CheckInput(instance); err != nil {
+		panic(err.Error())
+	}
+	for i := range raw {
+		raw[i] = M.baseScore
+		if M.baseScores != nil {
+			raw[i] = M.baseScores[i]
+		}
+	}
+	for round := first; round < last; round++ {
+		ensemble := M.b[round]
 		for class, tree := range ensemble {
-			tmp[class] += tree.PredictSingle(instance) * M.learningRate
+			if tree.VectorLeaf() {
+				tree.addPredictSingleVector(instance, M.learningRate*M.treeWeight(round, class), raw)
+				continue
+			}
+			raw[class] += tree.PredictSingle(instance) * M.learningRate * M.treeWeight(round, class)
+		}
+	}
+	return raw
+}
+
+// Returns the probabilities for the sample, as PredictSingle, but using only the boosting
+// rounds from first to last-1. The range is clamped to the rounds available. You can supply
+// a slice to be filled with the predictions in order to avoid allocation. The calibration,
+// if any, is not applied, as it was fitted for the whole ensemble.
+func (M *MultiClass) PredictSingleRange(instance []float64, first, last int, predictions ...[]float64) []float64 {
+	var preds []float64
+	if len(predictions) > 0 && len(predictions[0]) >= len(M.classLabels) {
+		preds = predictions[0][:len(M.classLabels)]
+	} else {
+		preds = make([]float64, len(M.classLabels))
+	}
+	first, last = max(first, 0), min(last, len(M.b))
+	preds = M.rawRange(instance, preds, first, max(first, last))
+	return M.activate(preds)
+}
+
+// Returns a new ensemble with only the boosting rounds from first to last-1 of M. The trees
+// are shared with M, which is not modified. The calibration, if any, is not kept, as it was
+// fitted for the whole ensemble.
+func (M *MultiClass) Slice(first, last int) (*MultiClass, error) {
+	if first < 0 || last > len(M.b) || first >= last {
+		return nil, fmt.Errorf("Invalid round range [%d,%d) for an ensemble with %d rounds", first, last, len(M.b))
+	}
+	ret := *M
+	ret.tmp, ret.predtmp = nil, nil
+	ret.calibration = nil
+	ret.b = slices.Clone(M.b[first:last])
+	if M.weights != nil {
+		ret.weights = slices.Clone(M.weights[first:last])
+	}
+	if len(M.oobLoss) == len(M.b) {
+		ret.oobLoss = slices.Clone(M.oobLoss[first:last])
+		ret.oobImprovement = slices.Clone(M.oobImprovement[first:last])
+	} else {
+		ret.oobLoss, ret.oobImprovement = nil, nil
+	}
+	return &ret, nil
+}
+
+// Returns a new ensemble with only the first n boosting rounds of M. See Slice.
+func (M *MultiClass) Truncate(n int) (*MultiClass, error) {
+	return M.Slice(0, n)
+}
+
+// Slice versions of the functions in ProbTransformMap, which can work in place.
+var activationMap = map[string]func([]float64, []float64) []float64{
+	"softmax":       utils.SoftMax,
+	"normalization": utils.Normalization,
+	"sigmoid":       utils.Sigmoid,
+}
+
+// Applies, in place, the activation function of the ensemble to the raw predictions given,
+// and returns them.
+func (M *MultiClass) activate(raw []float64) []float64 {
+	return rowActivation(M.probTransformName, M.probTransform)(raw)
+}
+
+// Returns a function that applies, in place, the activation with the given name to a row of raw
+// predictions, using the matrix version, transform, if there is no slice version of it.
+func rowActivation(name string, transform func(*mat.Dense, *mat.Dense) *mat.Dense) func([]float64) []float64 {
+	if f, ok := activationMap[name]; ok {
+		return func(raw []float64) []float64 { return f(raw, raw) }
+	}
+	return func(raw []float64) []float64 {
+		d := mat.NewDense(1, len(raw), raw)
+		transform(d, d)
+		return raw
+	}
+}
+
+// Returns an nxk matrix, where n is the number of data vectors and k the number of classes,
+// with the probability of each sample belonging to each class. The rows are processed
+// concurrently by the given number of workers (by default, GOMAXPROCS). Returns nil if
+// there is no data. Panics if a data vector has fewer features than the training data,
+// see PredictErr.
+func (M *MultiClass) Predict(data [][]float64, workers ...int) *mat.Dense {
+	if len(data) == 0 {
+		return nil
+	}
+	ret := mat.NewDense(len(data), len(M.classLabels), nil)
+	parallelRows(len(data), workers, func(i int) {
+		M.PredictSingle(data[i], ret.RawRowView(i))
+	})
+	return ret
+}
+
+// Same as Predict, but all the data vectors are checked first, and an error is returned,
+// instead of panicking, if any has fewer features than the training data.
+func (M *MultiClass) PredictErr(data [][]float64, workers ...int) (*mat.Dense, error) {
+	if err := checkRows(data, M.nfeatures); err != nil {
+		return nil, err
+	}
+	return M.Predict(data, workers...), nil
+}
+
+// Returns the raw predictions (margins, i.e., before the activation function) of the ensemble
+// for each class for the sample. You can supply a slice to be filled with the predictions in
+// order to avoid allocation.
+func (M *MultiClass) PredictSingleRaw(instance []float64, predictions ...[]float64) []float64 {
+	if len(predictions) > 0 && len(predictions[0]) >= len(M.classLabels) {
+		return M.rawSingle(instance, predictions[0][:len(M.classLabels)])
+	}
+	return M.rawSingle(instance, make([]float64, len(M.classLabels)))
+}
+
+// Same as Predict, but returns the raw predictions (margins) instead of probabilities.
+func (M *MultiClass) PredictRaw(data [][]float64, workers ...int) *mat.Dense {
+	if len(data) == 0 {
+		return nil
+	}
+	ret := mat.NewDense(len(data), len(M.classLabels), nil)
+	parallelRows(len(data), workers, func(i int) {
+		M.rawSingle(data[i], ret.RawRowView(i))
+	})
+	return ret
+}
+
+// Returns the index of the leaf reached by the sample in each tree of the ensemble.
+// The trees are in the order in which they are serialized to JSON (all the trees of
+// the first round, by class, then those of the second round, etc.) and the leaf indexes
+// are the node IDs in the JSON serialization. Panics if the sample has fewer features than
+// the training data.
+func (M *MultiClass) PredictSingleLeaf(instance []float64) []int {
+	if err := M.CheckInput(instance); err != nil {
+		panic(err.Error())
+	}
+	ret := make([]int, 0, len(M.b)*len(M.classLabels))
+	for _, ensemble := range M.b {
+		for _, tree := range ensemble {
+			ret = append(ret, tree.LeafIndex(instance))
+		}
+	}
+	return ret
+}
+
+// Returns, for each data vector, the result of PredictSingleLeaf. The rows are processed
+// concurrently by the given number of workers (by default, GOMAXPROCS).
+func (M *MultiClass) PredictLeaf(data [][]float64, workers ...int) [][]int {
+	ret := make([][]int, len(data))
+	parallelRows(len(data), workers, func(i int) {
+		ret[i] = M.PredictSingleLeaf(data[i])
+	})
+	return ret
+}
+
+// Calls fn for each index from 0 to n-1, splitting the indexes in contiguous chunks
+// that are processed concurrently by the given number of workers (GOMAXPROCS if no
+// number is given).
+func parallelRows(n int, workers []int, fn func(int)) {
+	if n == 0 {
+		return
+	}
+	nw := runtime.GOMAXPROCS(0)
+	if len(workers) > 0 && workers[0] > 0 {
+		nw = workers[0]
+	}
+	nw = min(nw, n)
+	chunk := (n + nw - 1) / nw
+	var wg sync.WaitGroup
+	for start := 0; start < n; start += chunk {
+		end := min(start+chunk, n)
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				fn(i)
+			}
+		}(start, end)
+	}
+	wg.Wait()
+}
+
+// Returns the predicted class label for each data vector. The rows are processed
+// concurrently by the given number of workers (by default, GOMAXPROCS).
+func (M *MultiClass) PredictClasses(data [][]float64, workers ...int) []int {
+	ret := make([]int, len(data))
+	if len(data) == 0 {
+		return ret
+	}
+	probs := M.Predict(data, workers...)
+	for i := range ret {
+		row := probs.RawRowView(i)
+		best := 0
+		for k, v := range row {
+			if v > row[best] {
+				best = k
+			}
+		}
+		ret[i] = M.classLabels[best]
+	}
+	return ret
+}
+
+// Returns the loss on the out-of-bag samples (those not sampled for the round) after each
+// boosting round. It is only available for freshly trained xgboost ensembles with
+// SubSample < 1, otherwise, nil is returned. Rounds without out-of-bag samples have NaN loss.
+func (M *MultiClass) OOBLoss() []float64 {
+	return slices.Clone(M.oobLoss)
+}
+
+// Returns, for each boosting round, the decrease in the loss on the out-of-bag samples
+// (those not sampled for the round) produced by the round. As the out-of-bag samples
+// were not used to build the round's trees, this is an estimate of the generalization
+// improvement. It is only available for freshly trained xgboost ensembles with SubSample < 1,
+// otherwise nil is returned.
+func (M *MultiClass) OOBImprovement() []float64 {
+	return slices.Clone(M.oobImprovement)
+}
+
+// Returns the weight of the tree for the given round and class. It is always 1
+// except for DART ensembles.
+func (M *MultiClass) treeWeight(round, class int) float64 {
+	if M.weights == nil {
+		return 1
+	}
+	return M.weights[round][class]
+}
+
+// Returns the labels for which the probability predicted for the sample is at least
+// threshold. Meant for multi-label ensembles.
+func (M *MultiClass) PredictSingleLabels(instance []float64, threshold float64) []int {
+	preds := M.PredictSingle(instance)
+	ret := make([]int, 0, 2)
+	for i, v := range preds {
+		if v >= threshold {
+			ret = append(ret, M.classLabels[i])
 		}
 	}
-	O := mat.NewDense(1, len(tmp), tmp)
-	D := mat.NewDense(1, len(preds), preds)
-	D = M.probTransform(O, D)
-	preds = D.RawMatrix().Data
-	return preds //SHOULD contain the numbers now.
+	return ret
 }
 
 // Returns the features ranked by their "importance" to the classification.
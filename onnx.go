@@ -0,0 +1,247 @@
+package boo
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// A minimal protocol buffers encoder, enough to write ONNX models.
+type protoBuffer []byte
+
+func (p *protoBuffer) varint(v uint64) {
+	*p = binary.AppendUvarint(*p, v)
+}
+
+func (p *protoBuffer) key(field, wiretype int) {
+	p.varint(uint64(field<<3 | wiretype))
+}
+
+func (p *protoBuffer) int(field int, v int64) {
+	p.key(field, 0)
+	p.varint(uint64(v))
+}
+
+func (p *protoBuffer) float(field int, v float32) {
+	p.key(field, 5)
+	*p = binary.LittleEndian.AppendUint32(*p, math.Float32bits(v))
+}
+
+func (p *protoBuffer) bytes(field int, b []byte) {
+	p.key(field, 2)
+	p.varint(uint64(len(b)))
+	*p = append(*p, b...)
+}
+
+func (p *protoBuffer) string(field int, s string) {
+	p.bytes(field, []byte(s))
+}
+
+func (p *protoBuffer) message(field int, m protoBuffer) {
+	p.bytes(field, m)
+}
+
+func (p *protoBuffer) packedInts(field int, v []int64) {
+	var b protoBuffer
+	for _, n := range v {
+		b.varint(uint64(n))
+	}
+	p.bytes(field, b)
+}
+
+func (p *protoBuffer) packedFloats(field int, v []float32) {
+	b := make([]byte, 0, 4*len(v))
+	for _, f := range v {
+		b = binary.LittleEndian.AppendUint32(b, math.Float32bits(f))
+	}
+	p.bytes(field, b)
+}
+
+// ONNX AttributeProto types and tensor element types.
+const (
+	onnxAttrFloats  = 6
+	onnxAttrInts    = 7
+	onnxAttrString  = 3
+	onnxAttrStrings = 8
+	onnxFloat       = 1
+	onnxInt64       = 7
+)
+
+func onnxIntsAttribute(name string, v []int64) protoBuffer {
+	var a protoBuffer
+	a.string(1, name)
+	a.packedInts(8, v)
+	a.int(20, onnxAttrInts)
+	return a
+}
+
+func onnxFloatsAttribute(name string, v []float32) protoBuffer {
+	var a protoBuffer
+	a.string(1, name)
+	a.packedFloats(7, v)
+	a.int(20, onnxAttrFloats)
+	return a
+}
+
+func onnxStringAttribute(name string, s string) protoBuffer {
+	var a protoBuffer
+	a.string(1, name)
+	a.string(4, s)
+	a.int(20, onnxAttrString)
+	return a
+}
+
+func onnxStringsAttribute(name string, s []string) protoBuffer {
+	var a protoBuffer
+	a.string(1, name)
+	for _, v := range s {
+		a.string(9, v)
+	}
+	a.int(20, onnxAttrStrings)
+	return a
+}
+
+// Returns a ValueInfoProto for a tensor with the given element type. Negative dimensions
+// are written as the symbolic dimension "N".
+func onnxTensorInfo(name string, elemType int, dims ...int) protoBuffer {
+	var shape protoBuffer
+	for _, d := range dims {
+		var dim protoBuffer
+		if d < 0 {
+			dim.string(2, "N")
+		} else {
+			dim.int(1, int64(d))
+		}
+		shape.message(1, dim)
+	}
+	var tensor protoBuffer
+	tensor.int(1, int64(elemType))
+	tensor.message(2, shape)
+	var typ protoBuffer
+	typ.message(1, tensor)
+	var ret protoBuffer
+	ret.string(1, name)
+	ret.message(2, typ)
+	return ret
+}
+
+// Writes the ensemble M as an ONNX model, with a single ai.onnx.ml TreeEnsembleClassifier node.
+// The model takes a float tensor "input", with one row per sample, and produces the
+// int64 tensor "label", with the predicted class labels, and the float tensor
+// "probabilities", with the probability of each class (in the order of ClassLabels) for
+// each sample. Multi-class (softmax) ensembles use the SOFTMAX post-transform, and multi-label
+// (sigmoid) ones, LOGISTIC. The number of features can be given, otherwise, the one of the
+// training data is used if known, or it is obtained from the features used in the trees.
+// Random forests and calibrated ensembles can't be exported.
+// Note that the ONNX runtimes compare features and thresholds in single precision, so samples
+// with features very close to a threshold might be split differently than in boo.
+func WriteONNX(M *MultiClass, w io.Writer, nfeatures ...int) error {
+	if M.calibration != nil {
+		return fmt.Errorf("Calibrated ensembles can't be exported to ONNX")
+	}
+	var transform string
+	switch M.probTransformName {
+	case "softmax":
+		transform = "SOFTMAX"
+	case "sigmoid":
+		transform = "LOGISTIC"
+	default:
+		return fmt.Errorf("Ensembles with activation %q can't be exported to ONNX", M.probTransformName)
+	}
+	var treeIDs, nodeIDs, features, trueIDs, falseIDs []int64
+	var modes []string
+	var values []float32
+	var cTreeIDs, cNodeIDs, cIDs []int64
+	var cWeights []float32
+	maxfeat := 0
+	C := M.Compile()
+	for t, tree := range C.Trees {
+		for n, f := range tree.Feature {
+			treeIDs = append(treeIDs, int64(t))
+			nodeIDs = append(nodeIDs, int64(n))
+			if f >= 0 {
+				maxfeat = max(maxfeat, f+1)
+				modes = append(modes, "BRANCH_LEQ")
+				features = append(features, int64(f))
+				values = append(values, float32(tree.Threshold[n]))
+				trueIDs = append(trueIDs, int64(tree.Left[n]))
+				falseIDs = append(falseIDs, int64(tree.Right[n]))
+				continue
+			}
+			modes = append(modes, "LEAF")
+			features = append(features, 0)
+			values = append(values, 0)
+			trueIDs = append(trueIDs, 0)
+			falseIDs = append(falseIDs, 0)
+			if c := C.Class[t]; c >= 0 {
+				cTreeIDs = append(cTreeIDs, int64(t))
+				cNodeIDs = append(cNodeIDs, int64(n))
+				cIDs = append(cIDs, int64(c))
+				cWeights = append(cWeights, float32(tree.Value[n]*C.Weight[t]))
+				continue
+			}
+			for k, v := range tree.Values[n*tree.Outputs : (n+1)*tree.Outputs] {
+				cTreeIDs = append(cTreeIDs, int64(t))
+				cNodeIDs = append(cNodeIDs, int64(n))
+				cIDs = append(cIDs, int64(k))
+				cWeights = append(cWeights, float32(v*C.Weight[t]))
+			}
+		}
+	}
+	if len(nfeatures) > 0 && nfeatures[0] > 0 {
+		maxfeat = nfeatures[0]
+	} else if M.nfeatures > 0 {
+		maxfeat = M.nfeatures
+	}
+	labels := make([]int64, len(C.ClassLabels))
+	base := make([]float32, len(C.ClassLabels))
+	for i, v := range C.ClassLabels {
+		labels[i] = int64(v)
+		base[i] = float32(C.BaseScores[i])
+	}
+	var node protoBuffer
+	node.string(1, "input")
+	node.string(2, "label")
+	node.string(2, "probabilities")
+	node.string(3, "TreeEnsembleClassifier")
+	node.string(4, "TreeEnsembleClassifier")
+	for _, a := range []protoBuffer{
+		onnxFloatsAttribute("base_values", base),
+		onnxIntsAttribute("class_ids", cIDs),
+		onnxIntsAttribute("class_nodeids", cNodeIDs),
+		onnxIntsAttribute("class_treeids", cTreeIDs),
+		onnxFloatsAttribute("class_weights", cWeights),
+		onnxIntsAttribute("classlabels_int64s", labels),
+		onnxIntsAttribute("nodes_falsenodeids", falseIDs),
+		onnxIntsAttribute("nodes_featureids", features),
+		onnxStringsAttribute("nodes_modes", modes),
+		onnxIntsAttribute("nodes_nodeids", nodeIDs),
+		onnxIntsAttribute("nodes_treeids", treeIDs),
+		onnxIntsAttribute("nodes_truenodeids", trueIDs),
+		onnxFloatsAttribute("nodes_values", values),
+		onnxStringAttribute("post_transform", transform),
+	} {
+		node.message(5, a)
+	}
+	node.string(7, "ai.onnx.ml")
+	var graph protoBuffer
+	graph.message(1, node)
+	graph.string(2, "boo")
+	graph.message(11, onnxTensorInfo("input", onnxFloat, -1, maxfeat))
+	graph.message(12, onnxTensorInfo("label", onnxInt64, -1))
+	graph.message(12, onnxTensorInfo("probabilities", onnxFloat, -1, len(labels)))
+	var model protoBuffer
+	model.int(1, 8) //IR version
+	model.string(2, "boo")
+	model.message(7, graph)
+	var opset, mlopset protoBuffer
+	opset.string(1, "")
+	opset.int(2, 17)
+	mlopset.string(1, "ai.onnx.ml")
+	mlopset.int(2, 3)
+	model.message(8, opset)
+	model.message(8, mlopset)
+	_, err := w.Write(model)
+	return err
+}
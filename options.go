@@ -1,7 +1,9 @@
 package boo
 
 import (
+	"encoding/json"
 	"fmt"
+	"strings"
 
 	"github.com/rmera/boo/utils"
 )
@@ -19,11 +21,19 @@ type Options struct {
 	SubSample      float64
 	ColSubSample   float64
 	BaseScore      float64
-	MinSample      int //the minimum samples in each tree
+	MinSample      int //the minimum number of subsampled rows for a round to be fitted. Only used if SubSample < 1
 	TreeMethod     string
+	DART           bool    //DART (dropout) boosting.
+	DropRate       float64 //fraction of the previous rounds dropped in each DART round
+	SkipDrop       float64 //probability of skipping the dropout in a given DART round
+	OOBEarlyStop   bool    //use the out-of-bag improvement, not the train loss, for early stopping. Requires SubSample < 1
+	MultiOutput    bool    //grow a single vector-leaf tree per round, with one value per class in each leaf. xgboost only.
 	//	EarlyStopRounds      int //stop after n consecutive rounds of no improvement. Not implemented yet.
-	Verbose bool
-	Loss    utils.LossFunc
+	Verbose   bool
+	Loss      utils.LossFunc
+	Objective utils.ObjectiveFunc //custom objective, replaces the gradients and Hessian from Loss. xgboost only.
+	Metric    utils.MetricFunc    //custom metric (lower is better) for the verbose output and early stopping.
+	lossName  string              //the name of a loss read from JSON that is not in LossMap.
 }
 
 // Returns a pointer to an Options structure with the default values
@@ -80,7 +90,10 @@ func (o *Options) Equal(O *Options) bool {
 	if O.BaseScore != o.BaseScore {
 		return false
 	}
-	if O.TreeMethod != "exact" {
+	if O.TreeMethod != o.TreeMethod {
+		return false
+	}
+	if O.EarlyStop != o.EarlyStop {
 		return false
 	}
 	if O.Loss != o.Loss {
@@ -92,27 +105,41 @@ func (o *Options) Equal(O *Options) bool {
 	if O.MinSample != o.MinSample {
 		return false
 	}
+	if O.DART != o.DART {
+		return false
+	}
+	if O.DropRate != o.DropRate {
+		return false
+	}
+	if O.SkipDrop != o.SkipDrop {
+		return false
+	}
+	if O.OOBEarlyStop != o.OOBEarlyStop {
+		return false
+	}
+	if O.MultiOutput != o.MultiOutput {
+		return false
+	}
+	//functions can't be compared, so we only check whether they are set.
+	if (O.Objective == nil) != (o.Objective == nil) || (O.Metric == nil) != (o.Metric == nil) {
+		return false
+	}
 	return true
 }
 
+// Returns a copy of the options. The loss, objective and metric are shared with o.
 func (o *Options) Clone() *Options {
-	O := new(Options)
-	O.XGB = o.XGB
-	O.Rounds = o.Rounds
-	O.SubSample = o.SubSample
-	O.ColSubSample = o.ColSubSample
-	O.Lambda = o.Lambda
-	O.MinChildWeight = o.MinChildWeight
-	O.Gamma = o.Gamma
-	O.MaxDepth = o.MaxDepth
-	O.LearningRate = o.LearningRate
-	O.BaseScore = o.BaseScore
-	O.TreeMethod = "exact"
-	O.Loss = o.Loss
-	O.Verbose = o.Verbose
-	O.MinSample = o.MinSample
-	return O
+	O := *o
+	return &O
+}
 
+// Returns the name of the loss. If the options were read from JSON and the loss
+// was not in LossMap, Loss is nil, but its name is still returned.
+func (o *Options) LossName() string {
+	if o.Loss != nil {
+		return o.Loss.Name()
+	}
+	return o.lossName
 }
 
 // Returns a pointer to an Options structure with the default
@@ -130,12 +157,26 @@ func DefaultGOptions() *Options {
 	return O
 }
 
+// Returns a pointer to an Options structure with the default
+// values for a DART (xgboost with dropouts) multi-class classification
+// ensamble.
+func DefaultDARTOptions() *Options {
+	O := DefaultXOptions()
+	O.DART = true
+	O.DropRate = 0.1
+	O.SkipDrop = 0.5
+	return O
+}
+
 func DefaultOptions() *Options {
 	return DefaultXOptions()
 }
 
 // Returns a string representation of the options
 func (O *Options) String() string {
+	if O.DART {
+		return fmt.Sprintf("dart %d r/%d md/%.3f lr/%.3f ss/%.3f bs/%.3f gam/%.3f lam/%.3f mcw/%.3f css/%.3f dr/%.3f sd", O.Rounds, O.MaxDepth, O.LearningRate, O.SubSample, O.BaseScore, O.Gamma, O.Lambda, O.MinChildWeight, O.ColSubSample, O.DropRate, O.SkipDrop)
+	}
 	if O.XGB {
 		return fmt.Sprintf("xgboost %d r/%d md/%.3f lr/%.3f ss/%.3f bs/%.3f gam/%.3f lam/%.3f mcw/%.3f css", O.Rounds, O.MaxDepth, O.LearningRate, O.SubSample, O.BaseScore, O.Gamma, O.Lambda, O.MinChildWeight, O.ColSubSample)
 	} else {
@@ -175,5 +216,89 @@ func (o *Options) Check() error {
 	if o.MinSample < 1 {
 		return n("MinSample %v", o.MinSample)
 	}
+	if o.DART && (o.DropRate < 0 || o.DropRate > 1 || o.SkipDrop < 0 || o.SkipDrop > 1) {
+		return n("DropRate or SkipDrop %v %v", o.DropRate, o.SkipDrop)
+	}
+	if o.OOBEarlyStop && (o.SubSample >= 1 || !o.XGB) {
+		return n("OOBEarlyStop requires xgboost and SubSample < 1, SubSample: %v", o.SubSample)
+	}
+	if o.MultiOutput && (!o.XGB || o.DART) {
+		return n("MultiOutput requires xgboost without DART")
+	}
+	if o.Objective != nil && !o.XGB {
+		return n("Custom objectives require xgboost")
+	}
+	return nil
+}
+
+// The losses that can be recovered, by name, when reading Options from JSON. The parameters
+// of the loss (such as the Delta of the Huber loss) are stored apart, and set on the
+// value returned. Names ending in a number, such as "quantile0.90", are looked up without
+// it. Other losses can be added so they can be read.
+var LossMap map[string]func() utils.LossFunc = map[string]func() utils.LossFunc{
+	"sqerr":       func() utils.LossFunc { return &utils.SQErrLoss{} },
+	"mse":         func() utils.LossFunc { return &utils.MSELoss{} },
+	"huber":       func() utils.LossFunc { return &utils.HuberLoss{} },
+	"pseudohuber": func() utils.LossFunc { return &utils.PseudoHuberLoss{} },
+	"quantile":    func() utils.LossFunc { return &utils.QuantileLoss{} },
+}
+
+type optionsAlias Options
+
+// The JSON representation of the Options. The loss is stored by name, and, as functions can't
+// be serialized, only whether a custom objective or metric was used is stored.
+type jsonOptions struct {
+	*optionsAlias
+	Loss       string          `json:",omitempty"`
+	LossParams json.RawMessage `json:",omitempty"` //the loss, marshaled to JSON
+	Objective  bool            `json:",omitempty"`
+	Metric     bool            `json:",omitempty"`
+}
+
+// Marshals the options to JSON.
+func (o *Options) MarshalJSON() ([]byte, error) {
+	j := &jsonOptions{optionsAlias: (*optionsAlias)(o), Objective: o.Objective != nil, Metric: o.Metric != nil}
+	if o.Loss != nil {
+		j.Loss = o.Loss.Name()
+		p, err := json.Marshal(o.Loss)
+		if err != nil {
+			return nil, fmt.Errorf("Error marshaling loss %s: %v", j.Loss, err)
+		}
+		if string(p) != "{}" {
+			j.LossParams = p
+		}
+	} else {
+		j.Loss = o.lossName
+	}
+	return json.Marshal(j)
+}
+
+// Unmarshals options from JSON. The loss, with its parameters, is recovered from LossMap.
+// If it is not there, as with custom losses, Loss is left nil and only its name is kept
+// (see LossName), the same as custom objectives and metrics, which are never recovered.
+func (o *Options) UnmarshalJSON(b []byte) error {
+	j := &jsonOptions{optionsAlias: (*optionsAlias)(o)}
+	if err := json.Unmarshal(b, j); err != nil {
+		return err
+	}
+	o.Loss = nil
+	o.lossName = ""
+	if j.Loss == "" {
+		return nil
+	}
+	f, ok := LossMap[j.Loss]
+	if !ok {
+		f, ok = LossMap[strings.TrimRight(j.Loss, "0123456789.")]
+	}
+	if !ok {
+		o.lossName = j.Loss
+		return nil
+	}
+	o.Loss = f()
+	if len(j.LossParams) > 0 {
+		if err := json.Unmarshal(j.LossParams, o.Loss); err != nil {
+			return fmt.Errorf("Error reading the parameters of loss %s: %v", j.Loss, err)
+		}
+	}
 	return nil
 }
@@ -0,0 +1,383 @@
+package boo
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/rmera/boo/utils"
+)
+
+// The subset of PMML 4.4 used to write and read boosted ensembles.
+type pmmlDocument struct {
+	XMLName        xml.Name           `xml:"PMML"`
+	Xmlns          string             `xml:"xmlns,attr,omitempty"`
+	Version        string             `xml:"version,attr"`
+	Header         pmmlHeader         `xml:"Header"`
+	DataDictionary pmmlDataDictionary `xml:"DataDictionary"`
+	MiningModel    *pmmlMiningModel   `xml:"MiningModel"`
+}
+
+type pmmlHeader struct {
+	Application struct {
+		Name string `xml:"name,attr"`
+	} `xml:"Application"`
+}
+
+type pmmlDataDictionary struct {
+	NumberOfFields int             `xml:"numberOfFields,attr"`
+	Fields         []pmmlDataField `xml:"DataField"`
+}
+
+type pmmlDataField struct {
+	Name     string      `xml:"name,attr"`
+	Optype   string      `xml:"optype,attr"`
+	DataType string      `xml:"dataType,attr"`
+	Values   []pmmlValue `xml:"Value"`
+}
+
+type pmmlValue struct {
+	Value string `xml:"value,attr"`
+}
+
+type pmmlMiningSchema struct {
+	Fields []pmmlMiningField `xml:"MiningField"`
+}
+
+type pmmlMiningField struct {
+	Name      string `xml:"name,attr"`
+	UsageType string `xml:"usageType,attr,omitempty"`
+}
+
+type pmmlOutputField struct {
+	Name          string `xml:"name,attr"`
+	Optype        string `xml:"optype,attr"`
+	DataType      string `xml:"dataType,attr"`
+	Feature       string `xml:"feature,attr"`
+	Value         string `xml:"value,attr,omitempty"`
+	IsFinalResult string `xml:"isFinalResult,attr,omitempty"`
+}
+
+type pmmlOutput struct {
+	Fields []pmmlOutputField `xml:"OutputField"`
+}
+
+type pmmlTargets struct {
+	Targets []pmmlTarget `xml:"Target"`
+}
+
+type pmmlTarget struct {
+	RescaleConstant float64 `xml:"rescaleConstant,attr"`
+}
+
+type pmmlMiningModel struct {
+	FunctionName string           `xml:"functionName,attr"`
+	MiningSchema pmmlMiningSchema `xml:"MiningSchema"`
+	Output       *pmmlOutput      `xml:"Output"`
+	Targets      *pmmlTargets     `xml:"Targets"`
+	Segmentation pmmlSegmentation `xml:"Segmentation"`
+}
+
+type pmmlSegmentation struct {
+	MultipleModelMethod string        `xml:"multipleModelMethod,attr"`
+	Segments            []pmmlSegment `xml:"Segment"`
+}
+
+type pmmlSegment struct {
+	ID              int                  `xml:"id,attr"`
+	True            *struct{}            `xml:"True"`
+	MiningModel     *pmmlMiningModel     `xml:"MiningModel"`
+	TreeModel       *pmmlTreeModel       `xml:"TreeModel"`
+	RegressionModel *pmmlRegressionModel `xml:"RegressionModel"`
+}
+
+type pmmlTreeModel struct {
+	FunctionName        string           `xml:"functionName,attr"`
+	SplitCharacteristic string           `xml:"splitCharacteristic,attr"`
+	MiningSchema        pmmlMiningSchema `xml:"MiningSchema"`
+	Node                pmmlNode         `xml:"Node"`
+}
+
+type pmmlNode struct {
+	Score           string               `xml:"score,attr,omitempty"`
+	True            *struct{}            `xml:"True"`
+	SimplePredicate *pmmlSimplePredicate `xml:"SimplePredicate"`
+	Nodes           []pmmlNode           `xml:"Node"`
+}
+
+type pmmlSimplePredicate struct {
+	Field    string `xml:"field,attr"`
+	Operator string `xml:"operator,attr"`
+	Value    string `xml:"value,attr"`
+}
+
+type pmmlRegressionModel struct {
+	FunctionName        string                `xml:"functionName,attr"`
+	NormalizationMethod string                `xml:"normalizationMethod,attr"`
+	MiningSchema        pmmlMiningSchema      `xml:"MiningSchema"`
+	Tables              []pmmlRegressionTable `xml:"RegressionTable"`
+}
+
+type pmmlRegressionTable struct {
+	Intercept      float64                `xml:"intercept,attr"`
+	TargetCategory string                 `xml:"targetCategory,attr"`
+	Predictors     []pmmlNumericPredictor `xml:"NumericPredictor"`
+}
+
+type pmmlNumericPredictor struct {
+	Name        string  `xml:"name,attr"`
+	Coefficient float64 `xml:"coefficient,attr"`
+}
+
+const pmmlTargetName = "class"
+
+func pmmlFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Returns the PMML node for the node n of the compiled tree, which belongs to the field names
+// given. value returns the score for a leaf.
+func pmmlTreeNode(C *CompiledTree, n int, names []string, value func(int) float64) pmmlNode {
+	if C.Feature[n] < 0 {
+		return pmmlNode{Score: pmmlFloat(value(n))}
+	}
+	f, t := names[C.Feature[n]], pmmlFloat(C.Threshold[n])
+	left := pmmlTreeNode(C, C.Left[n], names, value)
+	left.SimplePredicate = &pmmlSimplePredicate{Field: f, Operator: "lessOrEqual", Value: t}
+	right := pmmlTreeNode(C, C.Right[n], names, value)
+	right.SimplePredicate = &pmmlSimplePredicate{Field: f, Operator: "greaterThan", Value: t}
+	return pmmlNode{Nodes: []pmmlNode{left, right}}
+}
+
+// Writes the ensemble M as a PMML 4.4 document. The document contains a MiningModel
+// that chains, for each class, a MiningModel with the sum of that class's trees, and
+// a RegressionModel with a softmax normalization that turns the sums into probabilities.
+// keys are the names of the features (normally, the Keys of the training DataBunch),
+// if not given, the feature names of the training data are used, if known, or the features
+// are named x0, x1, etc.  The learning rate and tree weights (for DART)
+// are applied to the leaf scores. Only multi-class (softmax) ensembles without calibration can
+// be exported.
+func WritePMML(M *MultiClass, w io.Writer, keys ...string) error {
+	if M.calibration != nil {
+		return fmt.Errorf("Calibrated ensembles can't be exported to PMML")
+	}
+	if M.probTransformName != "softmax" {
+		return fmt.Errorf("Ensembles with activation %q can't be exported to PMML", M.probTransformName)
+	}
+	C := M.Compile()
+	nfeat := 0
+	for _, t := range C.Trees {
+		for _, f := range t.Feature {
+			nfeat = max(nfeat, f+1)
+		}
+	}
+	names := keys
+	if len(names) == 0 {
+		names = M.keys
+	}
+	if len(names) == 0 {
+		nfeat = max(nfeat, M.nfeatures)
+		names = make([]string, nfeat)
+		for i := range names {
+			names[i] = fmt.Sprintf("x%d", i)
+		}
+	}
+	if len(names) < nfeat {
+		return fmt.Errorf("The ensemble uses %d features, but only %d names were given", nfeat, len(names))
+	}
+	doc := &pmmlDocument{Xmlns: "http://www.dmg.org/PMML-4_4", Version: "4.4"}
+	doc.Header.Application.Name = "boo"
+	features := pmmlMiningSchema{}
+	for _, n := range names {
+		doc.DataDictionary.Fields = append(doc.DataDictionary.Fields, pmmlDataField{Name: n, Optype: "continuous", DataType: "double"})
+		features.Fields = append(features.Fields, pmmlMiningField{Name: n})
+	}
+	target := pmmlDataField{Name: pmmlTargetName, Optype: "categorical", DataType: "integer"}
+	probs := &pmmlOutput{}
+	for _, l := range C.ClassLabels {
+		v := strconv.Itoa(l)
+		target.Values = append(target.Values, pmmlValue{v})
+		probs.Fields = append(probs.Fields, pmmlOutputField{Name: "probability(" + v + ")", Optype: "continuous", DataType: "double", Feature: "probability", Value: v})
+	}
+	doc.DataDictionary.Fields = append(doc.DataDictionary.Fields, target)
+	doc.DataDictionary.NumberOfFields = len(doc.DataDictionary.Fields)
+	withTarget := pmmlMiningSchema{Fields: append([]pmmlMiningField{{Name: pmmlTargetName, UsageType: "target"}}, features.Fields...)}
+	top := &pmmlMiningModel{FunctionName: "classification", MiningSchema: withTarget, Output: probs}
+	top.Segmentation.MultipleModelMethod = "modelChain"
+	softmax := &pmmlRegressionModel{FunctionName: "classification", NormalizationMethod: "softmax"}
+	softmax.MiningSchema.Fields = []pmmlMiningField{{Name: pmmlTargetName, UsageType: "target"}}
+	for k, l := range C.ClassLabels {
+		out := fmt.Sprintf("boo(%d)", l)
+		sum := &pmmlMiningModel{FunctionName: "regression", MiningSchema: features}
+		sum.Output = &pmmlOutput{Fields: []pmmlOutputField{{Name: out, Optype: "continuous", DataType: "double", Feature: "predictedValue", IsFinalResult: "false"}}}
+		sum.Targets = &pmmlTargets{Targets: []pmmlTarget{{C.BaseScores[k]}}}
+		sum.Segmentation.MultipleModelMethod = "sum"
+		for t, tree := range C.Trees {
+			if C.Class[t] >= 0 && C.Class[t] != k {
+				continue
+			}
+			value := func(n int) float64 { return tree.Value[n] * C.Weight[t] }
+			if C.Class[t] < 0 {
+				value = func(n int) float64 { return tree.Values[n*tree.Outputs+k] * C.Weight[t] }
+			}
+			root := pmmlTreeNode(tree, 0, names, value)
+			root.True = &struct{}{}
+			tm := &pmmlTreeModel{FunctionName: "regression", SplitCharacteristic: "binarySplit", MiningSchema: features, Node: root}
+			sum.Segmentation.Segments = append(sum.Segmentation.Segments, pmmlSegment{ID: len(sum.Segmentation.Segments) + 1, True: &struct{}{}, TreeModel: tm})
+		}
+		top.Segmentation.Segments = append(top.Segmentation.Segments, pmmlSegment{ID: k + 1, True: &struct{}{}, MiningModel: sum})
+		softmax.MiningSchema.Fields = append(softmax.MiningSchema.Fields, pmmlMiningField{Name: out})
+		table := pmmlRegressionTable{TargetCategory: strconv.Itoa(l)}
+		table.Predictors = append(table.Predictors, pmmlNumericPredictor{out, 1})
+		softmax.Tables = append(softmax.Tables, table)
+	}
+	top.Segmentation.Segments = append(top.Segmentation.Segments, pmmlSegment{ID: len(C.ClassLabels) + 1, True: &struct{}{}, RegressionModel: softmax})
+	doc.MiningModel = top
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", " ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// Converts a PMML tree node into a boo Tree. features maps the field names to
+// feature indexes.
+func pmmlNodeToTree(n *pmmlNode, features map[string]int) (*Tree, error) {
+	ret := &Tree{xgb: true, branches: 1}
+	if len(n.Nodes) == 0 {
+		v, err := strconv.ParseFloat(n.Score, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid leaf score %q: %v", n.Score, err)
+		}
+		ret.value = v
+		return ret, nil
+	}
+	if len(n.Nodes) != 2 {
+		return nil, fmt.Errorf("Only binary splits are supported")
+	}
+	p := n.Nodes[0].SimplePredicate
+	if p == nil || p.Operator != "lessOrEqual" {
+		return nil, fmt.Errorf("Only lessOrEqual splits are supported")
+	}
+	f, ok := features[p.Field]
+	if !ok {
+		return nil, fmt.Errorf("Unknown field %q", p.Field)
+	}
+	t, err := strconv.ParseFloat(p.Value, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid threshold %q: %v", p.Value, err)
+	}
+	ret.splitFeatureIndex = f
+	ret.threshold = t
+	ret.bestScoreSoFar = math.SmallestNonzeroFloat64 //any non-zero value marks the node as a split
+	if ret.left, err = pmmlNodeToTree(&n.Nodes[0], features); err != nil {
+		return nil, err
+	}
+	if ret.right, err = pmmlNodeToTree(&n.Nodes[1], features); err != nil {
+		return nil, err
+	}
+	ret.branches += ret.left.branches + ret.right.branches
+	return ret, nil
+}
+
+// Reads a PMML document with the structure written by WritePMML, i.e. a chain of
+// per-class sums of trees followed by a softmax regression, and returns the
+// corresponding ensemble. The features are numbered in the order of the DataDictionary.
+func ReadPMML(r io.Reader) (*MultiClass, error) {
+	doc := &pmmlDocument{}
+	if err := xml.NewDecoder(r).Decode(doc); err != nil {
+		return nil, fmt.Errorf("Error decoding PMML: %v", err)
+	}
+	top := doc.MiningModel
+	if top == nil || top.FunctionName != "classification" || top.Segmentation.MultipleModelMethod != "modelChain" {
+		return nil, fmt.Errorf("The PMML document doesn't contain a chained classification MiningModel")
+	}
+	targets := make(map[string]bool)
+	for _, f := range top.MiningSchema.Fields {
+		if f.UsageType == "target" {
+			targets[f.Name] = true
+		}
+	}
+	features := make(map[string]int)
+	for _, f := range doc.DataDictionary.Fields {
+		if !targets[f.Name] {
+			features[f.Name] = len(features)
+		}
+	}
+	segs := top.Segmentation.Segments
+	if len(segs) < 2 || segs[len(segs)-1].RegressionModel == nil {
+		return nil, fmt.Errorf("The PMML model doesn't end in a RegressionModel")
+	}
+	reg := segs[len(segs)-1].RegressionModel
+	if reg.NormalizationMethod != "softmax" {
+		return nil, fmt.Errorf("Unsupported normalization method: %s", reg.NormalizationMethod)
+	}
+	//The sums of trees, by the name of their output.
+	sums := make(map[string]*pmmlMiningModel)
+	for _, s := range segs[:len(segs)-1] {
+		if s.MiningModel == nil || s.MiningModel.Output == nil || len(s.MiningModel.Output.Fields) != 1 {
+			return nil, fmt.Errorf("Segment %d is not a sum of trees", s.ID)
+		}
+		sums[s.MiningModel.Output.Fields[0].Name] = s.MiningModel
+	}
+	nclass := len(reg.Tables)
+	labels := make([]int, nclass)
+	margins := make([]float64, nclass)
+	var b [][]*Tree
+	for k, table := range reg.Tables {
+		var err error
+		if labels[k], err = strconv.Atoi(table.TargetCategory); err != nil {
+			return nil, fmt.Errorf("Invalid class label %q", table.TargetCategory)
+		}
+		if table.Intercept != 0 || len(table.Predictors) != 1 || table.Predictors[0].Coefficient != 1 {
+			return nil, fmt.Errorf("Unsupported regression table for class %s", table.TargetCategory)
+		}
+		sum, ok := sums[table.Predictors[0].Name]
+		if !ok || sum.Segmentation.MultipleModelMethod != "sum" {
+			return nil, fmt.Errorf("No sum of trees for class %s", table.TargetCategory)
+		}
+		if sum.Targets != nil && len(sum.Targets.Targets) > 0 {
+			margins[k] = sum.Targets.Targets[0].RescaleConstant
+		}
+		if len(sum.Segmentation.Segments) == 0 && len(b) == 0 {
+			b = append(b, make([]*Tree, nclass)) //filled with a constant tree below
+		}
+		for round, s := range sum.Segmentation.Segments {
+			if s.TreeModel == nil {
+				return nil, fmt.Errorf("Segment %d for class %s is not a TreeModel", s.ID, table.TargetCategory)
+			}
+			tree, err := pmmlNodeToTree(&s.TreeModel.Node, features)
+			if err != nil {
+				return nil, fmt.Errorf("Error in tree %d for class %s: %v", s.ID, table.TargetCategory, err)
+			}
+			for len(b) <= round {
+				b = append(b, make([]*Tree, nclass))
+			}
+			b[round][k] = tree
+		}
+	}
+	for _, round := range b {
+		for k := range round {
+			if round[k] == nil {
+				round[k] = constantTree(0)
+			}
+		}
+	}
+	if len(b) == 0 {
+		return nil, fmt.Errorf("No trees found in the PMML model")
+	}
+	keys := make([]string, len(features))
+	for k, i := range features {
+		keys[i] = k
+	}
+	ret := &MultiClass{b: b, learningRate: 1, probTransform: utils.SoftMaxDense, probTransformName: "softmax", classLabels: labels, xgb: true, keys: keys, nfeatures: len(keys)}
+	ret.setBaseScores(margins)
+	return ret, nil
+}
@@ -0,0 +1,243 @@
+package boo
+
+import (
+	"fmt"
+	"log"
+	"math"
+
+	"github.com/rmera/boo/utils"
+	"gonum.org/v1/gonum/mat"
+)
+
+// Regressor is a gradient-boosted (xgboost or "regular") ensemble with
+// one output per sample. It is used for the objectives that are not
+// multi-class classification, such as regression and ranking.
+type Regressor struct {
+	b             []*Tree
+	learningRate  float64
+	baseScore     float64
+	xgb           bool
+	objective     string
+	transform     func(float64) float64
+	transformName string //a key of RegressorTransformMap, empty for custom transformations
+}
+
+// The transformations of the raw predictions of Regressors that can be serialized, by name.
+var RegressorTransformMap map[string]func(float64) float64 = map[string]func(float64) float64{
+	"identity": func(x float64) float64 { return x },
+	"exp":      math.Exp,
+	"sigmoid":  func(x float64) float64 { return 1 / (1 + math.Exp(-x)) },
+	//sign(x)*x², for LightGBM's regressions on the square root of the target.
+	"signsquare": func(x float64) float64 { return x * math.Abs(x) },
+	//log(1+exp(x)), for LightGBM's cross_entropy_lambda.
+	"softplus": func(x float64) float64 { return math.Max(x, 0) + math.Log1p(math.Exp(-math.Abs(x))) },
+}
+
+// Returns the key of RegressorTransformMap for the function f, or an empty string
+// if f is not one of them. As functions can't be compared, f is evaluated at a few points.
+func regressorTransformName(f func(float64) float64) string {
+	if f == nil {
+		return "identity"
+	}
+	for name, g := range RegressorTransformMap {
+		same := true
+		for _, x := range []float64{-1.5, 0, 0.7, 2} {
+			if f(x) != g(x) {
+				same = false
+				break
+			}
+		}
+		if same {
+			return name
+		}
+	}
+	return ""
+}
+
+// Produces (and fits) a new single-output boosted tree ensemble, minimizing the
+// objective obj. It will be of xgboost type if the XGB option is true, regular gradient
+// boosting othewise. The Loss and Objective in the options are not used, but, if a Metric
+// is given, it is used instead of the objective's value for the verbose output and early stopping.
+// It panics, before the training, if obj implements utils.Checker and its parameters are wrong.
+func NewRegressor(D *utils.DataBunch, obj utils.Objective, opts ...*Options) *Regressor {
+	var O *Options
+	if len(opts) > 0 && opts[0] != nil {
+		O = opts[0]
+	} else {
+		O = DefaultXOptions()
+	}
+	if c, ok := obj.(utils.Checker); ok {
+		if err := c.Check(); err != nil {
+			panic(err.Error())
+		}
+	}
+	if O.MinChildWeight < 1 {
+		O.MinChildWeight = 1
+	}
+	n := len(D.Data)
+	raw := make([]float64, n)
+	for i := range raw {
+		raw[i] = O.BaseScore
+	}
+	grads := make([]float64, n)
+	hess := make([]float64, n)
+	tmpPreds := make([]float64, n)
+	tin := make([]int, n)
+	tval := make([]float64, n)
+	trees := make([]*Tree, 0, O.Rounds)
+	var prevloss float64
+	roundsNoProgress := 0
+	for round := 0; round < O.Rounds; round++ {
+		var sampleIndexes, sampleCols []int
+		if O.SubSample < 1 && O.XGB {
+			sampleIndexes = SubSample(n, O.SubSample)
+			if len(sampleIndexes) < O.MinSample {
+				continue
+			}
+		}
+		if O.ColSubSample < 1 && O.XGB {
+			sampleCols = SubSample(len(D.Data[0]), O.ColSubSample)
+		}
+		obj.GradHess(D, raw, grads, hess)
+		var tree *Tree
+		if O.XGB {
+			tOpts := DefaultXTreeOptions()
+			tOpts.MinChildWeight = O.MinChildWeight
+			tOpts.MaxDepth = O.MaxDepth
+			tOpts.Lambda = O.Lambda
+			tOpts.Gamma = O.Gamma
+			tOpts.Indexes = sampleIndexes
+			tOpts.AllowedColumns = sampleCols
+			tOpts.Gradients = grads
+			tOpts.Hessian = hess
+			tOpts.in = tin
+			tOpts.val = tval
+			tree = NewTree(D.Data, tOpts)
+		} else {
+			tOpts := DefaultGTreeOptions()
+			tOpts.in = tin
+			tOpts.val = tval
+			tOpts.MinChildWeight = O.MinChildWeight
+			tOpts.MaxDepth = O.MaxDepth
+			neggrads := make([]float64, n)
+			for i, v := range grads {
+				neggrads[i] = -v
+			}
+			tOpts.Y = neggrads
+			tree = NewTree(D.Data, tOpts)
+			if lu, ok := obj.(utils.LeafUpdater); ok {
+				pred := make([]float64, n)
+				for i, v := range raw {
+					pred[i] = obj.Transform(v)
+				}
+				updateLeavesResiduals(tree, D.FloatTargets(), pred, lu)
+			} else {
+				updateLeaves(tree, mat.NewDense(1, n, neggrads), mat.NewDense(1, n, hess))
+			}
+		}
+		tmpPreds = tree.Predict(D.Data, tmpPreds)
+		for i, v := range tmpPreds {
+			raw[i] += O.LearningRate * v
+		}
+		trees = append(trees, tree)
+		var currloss float64
+		if O.EarlyStop > 0 || O.Verbose {
+			currloss = obj.Value(D, raw)
+			if O.Metric != nil {
+				currloss = O.Metric(D.FloatTargets(), raw)
+			}
+		}
+		if O.Verbose {
+			fmt.Printf("round: %d, train loss (%s) = %.3f\n", round, obj.Name(), currloss)
+		}
+		if O.EarlyStop > 0 {
+			if round == 0 {
+				prevloss = currloss
+				continue
+			}
+			if prevloss <= currloss {
+				roundsNoProgress++
+			} else {
+				roundsNoProgress = 0
+			}
+			if roundsNoProgress >= O.EarlyStop {
+				if O.Verbose {
+					log.Println("Stopped early at round", round)
+				}
+				break
+			}
+			prevloss = currloss
+		}
+	}
+	return &Regressor{b: trees, learningRate: O.LearningRate, baseScore: O.BaseScore, xgb: O.XGB, objective: obj.Name(), transform: obj.Transform, transformName: regressorTransformName(obj.Transform)}
+}
+
+// Like NewRegressor, but the options, and the objective, if it implements utils.Checker,
+// are checked first, and an error is returned instead of causing a panic.
+func FitRegressor(D *utils.DataBunch, obj utils.Objective, opts ...*Options) (*Regressor, error) {
+	O := DefaultXOptions()
+	if len(opts) > 0 && opts[0] != nil {
+		O = opts[0]
+	}
+	if err := O.Check(); err != nil {
+		return nil, err
+	}
+	if c, ok := obj.(utils.Checker); ok {
+		if err := c.Check(); err != nil {
+			return nil, err
+		}
+	}
+	return NewRegressor(D, obj, O), nil
+}
+
+// Returns the number of boosting rounds in the ensemble.
+func (R *Regressor) Rounds() int {
+	return len(R.b)
+}
+
+// Returns the name of the objective the ensemble was trained with.
+func (R *Regressor) Objective() string {
+	return R.objective
+}
+
+// Returns the raw prediction (before the transformation of the objective) for a single sample.
+func (R *Regressor) PredictSingleRaw(instance []float64) float64 {
+	ret := R.baseScore
+	for _, tree := range R.b {
+		ret += tree.PredictSingle(instance) * R.learningRate
+	}
+	return ret
+}
+
+// Returns the prediction for a single sample.
+func (R *Regressor) PredictSingle(instance []float64) float64 {
+	ret := R.PredictSingleRaw(instance)
+	if R.transform == nil {
+		return ret
+	}
+	return R.transform(ret)
+}
+
+// Predicts a value for each data vector. If preds is not nil, predicted values
+// are stored there.
+func (R *Regressor) Predict(data [][]float64, preds []float64) []float64 {
+	if preds == nil {
+		preds = make([]float64, len(data))
+	}
+	for i, v := range data {
+		preds[i] = R.PredictSingle(v)
+	}
+	return preds
+}
+
+// Returns the features ranked by their "importance" to the predictions.
+func (R *Regressor) FeatureImportance() (*Feats, error) {
+	ret := NewFeats(R.xgb)
+	for round, tree := range R.b {
+		_, err := tree.FeatureImportance(R.xgb, ret)
+		if err != nil {
+			return nil, fmt.Errorf("Error with features of tree for boosting round %d", round)
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,141 @@
+package boo
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Writes the ensemble M to w in the version 2 JSON format (see WriteJSONModel), gzip-compressed
+// if compress is given and true.
+func WriteModel(M *MultiClass, w io.Writer, compress ...bool) error {
+	if len(compress) == 0 || !compress[0] {
+		return WriteJSONModel(M, w)
+	}
+	gz := gzip.NewWriter(w)
+	if err := WriteJSONModel(M, gz); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Reads an ensemble from r, in any of the formats written by boo: the binary format, the
+// version 2 JSON format or the older, line-based, JSON one. gzip-compressed data is
+// detected and decompressed.
+func ReadModel(r io.Reader) (*MultiClass, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(binaryMagic))
+	if len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("Error decompressing model: %v", err)
+		}
+		defer gz.Close()
+		return ReadModel(gz)
+	}
+	if string(magic) == binaryMagic {
+		return ReadBinary(br)
+	}
+	return ReadJSONModel(br)
+}
+
+// Saves the ensemble M to the file filename. The binary format is used if the name ends with
+// ".bin" (or ".bin.gz") and the version 2 JSON one otherwise. The file is gzip-compressed if its
+// name ends with ".gz". The model is written to a temporary file in the same directory, which
+// then replaces filename, so an existing file is not lost if the writing fails.
+func SaveModel(M *MultiClass, filename string) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(filename); err == nil {
+		mode = info.Mode().Perm()
+	}
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) //fails harmlessly after the rename
+	compress := strings.HasSuffix(filename, ".gz")
+	base := strings.TrimSuffix(filename, ".gz")
+	w := bufio.NewWriter(f)
+	var out io.Writer = w
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(w)
+		out = gz
+	}
+	if strings.HasSuffix(base, ".bin") {
+		err = WriteBinary(M, out)
+	} else {
+		err = WriteJSONModel(M, out)
+	}
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// Loads an ensemble from the file filename, in any of the formats accepted by ReadModel.
+func LoadModel(filename string) (*MultiClass, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadModel(f)
+}
+
+// Implements encoding.TextMarshaler, using the version 2 JSON format.
+func (M *MultiClass) MarshalText() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := WriteJSONModel(M, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Implements encoding.TextUnmarshaler. Accepts any of the formats read by ReadModel.
+func (M *MultiClass) UnmarshalText(text []byte) error {
+	ret, err := ReadModel(bytes.NewReader(text))
+	if err != nil {
+		return err
+	}
+	*M = *ret
+	return nil
+}
+
+// Implements json.Marshaler, so an ensemble can be part of a larger JSON document.
+// It is marshaled in the version 2 JSON format.
+func (M *MultiClass) MarshalJSON() ([]byte, error) {
+	return json.Marshal(M.JSONModel())
+}
+
+// Implements json.Unmarshaler, for ensembles in the version 2 JSON format.
+func (M *MultiClass) UnmarshalJSON(b []byte) error {
+	j := &JSONModel{}
+	if err := json.Unmarshal(b, j); err != nil {
+		return err
+	}
+	ret, err := j.MultiClass()
+	if err != nil {
+		return err
+	}
+	*M = *ret
+	return nil
+}
@@ -21,13 +21,17 @@ type Tree struct {
 	id                int //only trees read from files have id
 	grads             []float64
 	hess              []float64
+	mgrads            [][]float64 //only for vector-leaf trees
+	mhess             [][]float64
 	x                 [][]float64
 	y                 []float64
 	samples           []int
 	bestScoreSoFar    float64
 	value             float64
-	nsamples          int //n
-	features          int //c
+	values            []float64 //one value per output, only for vector-leaf trees
+	outs              int       //len(values) in the leaves, kept in every node
+	nsamples          int       //n
+	features          int       //c
 	splitFeatureIndex int
 	threshold         float64
 	left              *Tree
@@ -47,6 +51,8 @@ type TreeOptions struct {
 	ColSampleByNode float64 //not used
 	Gradients       []float64
 	Hessian         []float64
+	MultiGradients  [][]float64 //gradients for each output (class), for vector-leaf xgboost trees
+	MultiHessian    [][]float64 //Hessians for each output, for vector-leaf xgboost trees
 	Y               []float64
 	in              []int
 	val             []float64
@@ -75,6 +81,8 @@ func (T *TreeOptions) clone() *TreeOptions {
 	ret.XGB = T.XGB
 	ret.Gradients = T.Gradients
 	ret.Hessian = T.Hessian
+	ret.MultiGradients = T.MultiGradients
+	ret.MultiHessian = T.MultiHessian
 	ret.Y = T.Y
 	ret.MinChildWeight = T.MinChildWeight
 	ret.Lambda = T.Lambda
@@ -91,7 +99,7 @@ func (T *TreeOptions) clone() *TreeOptions {
 func NewTree(X [][]float64, o *TreeOptions) *Tree {
 	ret := &Tree{}
 	if o.XGB {
-		if o.Gradients == nil && o.Hessian == nil {
+		if o.Gradients == nil && o.Hessian == nil && o.MultiGradients == nil {
 			panic("nil gradients/hessians in XGBoost tree")
 		}
 		ret.xgb = true
@@ -112,7 +120,16 @@ func NewTree(X [][]float64, o *TreeOptions) *Tree {
 	ret.grads = o.Gradients
 	ret.hess = o.Hessian
 	ret.y = o.Y
-	if ret.xgb {
+	ret.mgrads = o.MultiGradients
+	ret.mhess = o.MultiHessian
+	if ret.xgb && ret.mgrads != nil {
+		ret.outs = len(ret.mgrads)
+		ret.values = make([]float64, ret.outs)
+		for k := range ret.values {
+			ret.values[k] = -1 * floats.Sum(utils.SampleSlice(ret.mgrads[k], o.Indexes)) / (floats.Sum(utils.SampleSlice(ret.mhess[k], o.Indexes)) + o.Lambda)
+		}
+		ret.bestScoreSoFar = 0.0
+	} else if ret.xgb {
 		ret.value = -1 * floats.Sum(utils.SampleSlice(ret.grads, o.Indexes)) / (floats.Sum(utils.SampleSlice(ret.hess, o.Indexes)) + o.Lambda) //eq 5
 		ret.bestScoreSoFar = 0.0
 	} else {
@@ -141,6 +158,10 @@ func (T *Tree) maybeInsertChildNode(o *TreeOptions) {
 			continue
 		}
 		T.debug(o, "Will split by (zero-based) feature", i) //
+		if T.mgrads != nil {
+			T.findBetterSplitMulti(i, o)
+			continue
+		}
 		T.findBetterSplit(i, o)
 	}
 	if T.Leaf() {
@@ -170,6 +191,7 @@ func (T *Tree) maybeInsertChildNode(o *TreeOptions) {
 	oright.in = o.in
 	oright.val = o.val
 	//end note
+	T.values = nil //only leaves keep their values
 	T.left = NewTree(T.x, oleft)
 	T.branches += T.left.branches
 	T.right = NewTree(T.x, oright)
@@ -252,6 +274,56 @@ func (T *Tree) findBetterSplit(featureIndex int, o *TreeOptions) {
 	}
 }
 
+// Same as findBetterSplit, but for vector-leaf xgboost trees, where the gain
+// of a split is the sum of the gains for each output.
+func (T *Tree) findBetterSplitMulti(featureIndex int, o *TreeOptions) {
+	x := utils.SampleMatrix(T.x, o.Indexes, []int{featureIndex})
+	xt := utils.TransposeFloats(x)
+	in := o.in[0:len(xt[0])]
+	val := o.val[0:len(xt[0])]
+	sorted_indexes, sortx := utils.MemArgSort(xt[0], in, val)
+	nk := len(T.mgrads)
+	sortg := make([][]float64, nk)
+	sorth := make([][]float64, nk)
+	sumg := make([]float64, nk)
+	sumh := make([]float64, nk)
+	sumgLeft := make([]float64, nk)
+	sumhLeft := make([]float64, nk)
+	for k := range T.mgrads {
+		sortg[k] = utils.SampleSlice(utils.SampleSlice(T.mgrads[k], o.Indexes), sorted_indexes)
+		sorth[k] = utils.SampleSlice(utils.SampleSlice(T.mhess[k], o.Indexes), sorted_indexes)
+		sumg[k], sumh[k] = floats.Sum(sortg[k]), floats.Sum(sorth[k])
+	}
+	sq := func(x float64) float64 { return x * x }
+	var nleft, nright int = 0, T.nsamples
+	for i := 0; i < T.nsamples-1; i++ {
+		nright--
+		nleft++
+		for k := range sumgLeft {
+			sumgLeft[k] += sortg[k][i]
+			sumhLeft[k] += sorth[k][i]
+		}
+		xi, xinext := sortx[i], sortx[i+1]
+		if nleft < int(o.MinChildWeight) || xi == xinext {
+			continue
+		}
+		if nright < int(o.MinChildWeight) {
+			break
+		}
+		gain := -o.Gamma / 2 //see the note in findBetterSplit
+		for k := range sumgLeft {
+			gl, hl := sumgLeft[k], sumhLeft[k]
+			gr, hr := sumg[k]-gl, sumh[k]-hl
+			gain += 0.5 * ((sq(gl) / (hl + o.Lambda)) + (sq(gr) / (hr + o.Lambda)) - (sq(sumg[k]) / (sumh[k] + o.Lambda)))
+		}
+		if gain > T.bestScoreSoFar {
+			T.splitFeatureIndex = featureIndex
+			T.bestScoreSoFar = gain
+			T.threshold = (xi + xinext) / 2
+		}
+	}
+}
+
 // Returns the number of branches in the tree
 func (T *Tree) Branches() int {
 	return T.branches
@@ -281,10 +353,20 @@ func (T *Tree) Predict(data [][]float64, preds []float64) []float64 {
 	return preds
 }
 
-// Predicts a value for a single data vector.
+// Predicts a value for a single data vector. Panics for vector-leaf trees,
+// which have one value per output.
 func (T *Tree) PredictSingle(row []float64) float64 {
+	leaf := T.leafFor(row)
+	if leaf.values != nil {
+		panic("PredictSingle called on a vector-leaf tree")
+	}
+	return leaf.value
+}
+
+// Returns the leaf in which a data vector falls.
+func (T *Tree) leafFor(row []float64) *Tree {
 	if T.Leaf() {
-		return T.value
+		return T
 	}
 	var child *Tree
 	if row[T.splitFeatureIndex] <= T.threshold {
@@ -292,7 +374,58 @@ func (T *Tree) PredictSingle(row []float64) float64 {
 	} else {
 		child = T.right
 	}
-	return child.PredictSingle(row)
+	return child.leafFor(row)
+}
+
+// Returns the index of the leaf in which a data vector falls. The nodes are numbered in
+// preorder, starting with 1 for the root, which is the same numbering used for the node IDs
+// in the JSON serialization.
+func (T *Tree) LeafIndex(row []float64) int {
+	id := 1
+	node := T
+	for !node.Leaf() {
+		if row[node.splitFeatureIndex] <= node.threshold {
+			id++
+			node = node.left
+		} else {
+			id += 1 + node.left.branches
+			node = node.right
+		}
+	}
+	return id
+}
+
+// Returns true if the tree has vector leaves, i.e., one value per output (class)
+// in each leaf.
+func (T *Tree) VectorLeaf() bool {
+	return T.outputs() > 0
+}
+
+// Returns the number of values in the leaves of the tree, 0 if it
+// doesn't have vector leaves.
+func (T *Tree) outputs() int {
+	return T.outs
+}
+
+// Sets the number of values in the leaves on every node of T, for trees
+// built from files, where only the leaves store their values. Returns it.
+func (T *Tree) setOutputs() int {
+	if T.Leaf() {
+		T.outs = len(T.values)
+		return T.outs
+	}
+	T.right.setOutputs()
+	T.outs = T.left.setOutputs()
+	return T.outs
+}
+
+// For vector-leaf trees, adds scale times the leaf values for a single data vector to ret.
+// Returns ret.
+func (T *Tree) addPredictSingleVector(row []float64, scale float64, ret []float64) []float64 {
+	for k, v := range T.leafFor(row).values {
+		ret[k] += v * scale
+	}
+	return ret
 }
 
 // If given the featurenames, returns the name of the split feature for the node. If not,
@@ -314,6 +447,10 @@ func (T *Tree) Print(spacing string, featurenames ...[]string) string {
 	}
 	if T.Leaf() {
 		returnString := "  " + spacing + "PREDICT    "
+		if T.values != nil {
+			returnString += fmt.Sprintf("%.3f with %d Samples", T.values, T.samples) + "\n"
+			return returnString
+		}
 		returnString += fmt.Sprintf("%.3f with %d Samples", T.value, T.samples) + "\n"
 		return returnString
 
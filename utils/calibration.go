@@ -0,0 +1,240 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// Calibration contains a per-class mapping from predicted to calibrated probabilities,
+// either Platt scaling ("platt") or isotonic regression ("isotonic"). The fields are
+// exported only so the calibration can be serialized.
+type Calibration struct {
+	Method    string
+	Normalize bool        //the calibrated probabilities are normalized to add up to 1
+	A, B      []float64   `json:",omitempty"` //Platt parameters, one per class
+	X, Y      [][]float64 `json:",omitempty"` //isotonic breakpoints, one set per class
+}
+
+// Fits a calibration with the given method ("platt" or "isotonic") for the n x k
+// matrix of predicted probabilities probs, where the targets n x k matrix contains 1 in
+// the element i,j if the sample i belongs to the class j, and 0 otherwise. If normalize is true,
+// the calibrated probabilities for each sample will be normalized to add up to 1 (as needed
+// for multi-class, but not for multi-label, classification).
+func FitCalibration(method string, probs, targets *mat.Dense, normalize bool) (*Calibration, error) {
+	_, c := probs.Dims()
+	ret := &Calibration{Method: method, Normalize: normalize}
+	for k := 0; k < c; k++ {
+		p := DenseCol(probs, k).RawRowView(0)
+		t := DenseCol(targets, k).RawRowView(0)
+		switch method {
+		case "platt":
+			a, b := plattFit(p, t)
+			ret.A = append(ret.A, a)
+			ret.B = append(ret.B, b)
+		case "isotonic":
+			x, y := isotonicFit(p, t)
+			ret.X = append(ret.X, x)
+			ret.Y = append(ret.Y, y)
+		default:
+			return nil, fmt.Errorf("Unknown calibration method: %s", method)
+		}
+	}
+	return ret, nil
+}
+
+// Replaces the probabilities in probs (one per class) by their calibrated
+// values, and returns probs.
+func (C *Calibration) Apply(probs []float64) []float64 {
+	var sum float64
+	for k, v := range probs {
+		if C.Method == "platt" {
+			probs[k] = 1 / (1 + math.Exp(C.A[k]*logit(v)+C.B[k]))
+		} else {
+			probs[k] = interpolate(C.X[k], C.Y[k], v)
+		}
+		sum += probs[k]
+	}
+	if C.Normalize && sum > 0 {
+		for k := range probs {
+			probs[k] /= sum
+		}
+	}
+	return probs
+}
+
+// Returns the log of the odds for the probability p, clamped
+// to avoid infinite values.
+func logit(p float64) float64 {
+	eps := 1e-12
+	p = math.Min(math.Max(p, eps), 1-eps)
+	return math.Log(p / (1 - p))
+}
+
+// Fits the Platt parameters A and B, so 1/(1+exp(A*f+B)), where f is the logit of
+// each probability p, best fits the targets t. It uses Newton's method with backtracking
+// and Platt's regularized targets, as in Lin, Lin and Weng, Machine Learning 68, 267 (2007).
+func plattFit(p, t []float64) (float64, float64) {
+	var prior1, prior0 float64
+	for _, v := range t {
+		if v > 0.5 {
+			prior1++
+		} else {
+			prior0++
+		}
+	}
+	hi, lo := (prior1+1)/(prior1+2), 1/(prior0+2)
+	f := make([]float64, len(p))
+	tt := make([]float64, len(p))
+	for i, v := range p {
+		f[i] = logit(v)
+		tt[i] = lo
+		if t[i] > 0.5 {
+			tt[i] = hi
+		}
+	}
+	//the objective: negative log likelihood, computed in a numerically stable way
+	fval := func(A, B float64) float64 {
+		var ret float64
+		for i, v := range f {
+			fApB := v*A + B
+			if fApB >= 0 {
+				ret += tt[i]*fApB + math.Log1p(math.Exp(-fApB))
+			} else {
+				ret += (tt[i]-1)*fApB + math.Log1p(math.Exp(fApB))
+			}
+		}
+		return ret
+	}
+	A, B := 0.0, math.Log((prior0+1)/(prior1+1))
+	sigma := 1e-12
+	current := fval(A, B)
+	for iter := 0; iter < 100; iter++ {
+		var h11, h22, h21, g1, g2 float64
+		h11, h22 = sigma, sigma
+		for i, v := range f {
+			fApB := v*A + B
+			var p, q float64
+			if fApB >= 0 {
+				p = math.Exp(-fApB) / (1 + math.Exp(-fApB))
+				q = 1 / (1 + math.Exp(-fApB))
+			} else {
+				p = 1 / (1 + math.Exp(fApB))
+				q = math.Exp(fApB) / (1 + math.Exp(fApB))
+			}
+			d2 := p * q
+			h11 += v * v * d2
+			h22 += d2
+			h21 += v * d2
+			d1 := tt[i] - p
+			g1 += v * d1
+			g2 += d1
+		}
+		if math.Abs(g1) < 1e-5 && math.Abs(g2) < 1e-5 {
+			break
+		}
+		det := h11*h22 - h21*h21
+		dA := -(h22*g1 - h21*g2) / det
+		dB := -(-h21*g1 + h11*g2) / det
+		gd := g1*dA + g2*dB
+		step := 1.0
+		for step >= 1e-10 {
+			newA, newB := A+step*dA, B+step*dB
+			newf := fval(newA, newB)
+			if newf < current+0.0001*step*gd {
+				A, B, current = newA, newB, newf
+				break
+			}
+			step /= 2
+		}
+		if step < 1e-10 {
+			break
+		}
+	}
+	return A, B
+}
+
+// Fits a non-decreasing function from the probabilities p to the targets t
+// with the pool-adjacent-violators algorithm. Returns the mean probability
+// and the fitted value for each block.
+func isotonicFit(p, t []float64) ([]float64, []float64) {
+	order := make([]int, len(p))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return p[order[a]] < p[order[b]] })
+	x := make([]float64, 0, len(p))
+	y := make([]float64, 0, len(p))
+	w := make([]float64, 0, len(p))
+	for _, i := range order {
+		x = append(x, p[i])
+		y = append(y, t[i])
+		w = append(w, 1)
+		for n := len(y); n > 1 && y[n-2] >= y[n-1]; n = len(y) {
+			tw := w[n-2] + w[n-1]
+			x[n-2] = (x[n-2]*w[n-2] + x[n-1]*w[n-1]) / tw
+			y[n-2] = (y[n-2]*w[n-2] + y[n-1]*w[n-1]) / tw
+			w[n-2] = tw
+			x, y, w = x[:n-1], y[:n-1], w[:n-1]
+		}
+	}
+	return x, y
+}
+
+// Returns the value at v of the piecewise-linear function through the points x,y
+// (with x sorted), which is constant beyond the first and last points.
+func interpolate(x, y []float64, v float64) float64 {
+	if len(x) == 0 {
+		return v
+	}
+	if v <= x[0] {
+		return y[0]
+	}
+	if v >= x[len(x)-1] {
+		return y[len(y)-1]
+	}
+	j := sort.SearchFloat64s(x, v)
+	if x[j] == v {
+		return y[j]
+	}
+	f := (v - x[j-1]) / (x[j] - x[j-1])
+	return y[j-1] + f*(y[j]-y[j-1])
+}
+
+// Divides the predicted probabilities in bins of equal width, and returns, for each bin,
+// the mean predicted probability, the fraction of positive outcomes (outcomes are 1 for positive
+// and 0 for negative), and the number of samples in the bin. Empty bins have NaN means and fractions.
+func ReliabilityCurve(probs, outcomes []float64, bins int) ([]float64, []float64, []int) {
+	meanp := make([]float64, bins)
+	frac := make([]float64, bins)
+	counts := make([]int, bins)
+	for i, p := range probs {
+		b := int(p * float64(bins))
+		b = min(max(b, 0), bins-1)
+		meanp[b] += p
+		frac[b] += outcomes[i]
+		counts[b]++
+	}
+	for b, c := range counts {
+		meanp[b] /= float64(c)
+		frac[b] /= float64(c)
+	}
+	return meanp, frac, counts
+}
+
+// Returns the expected calibration error: the average, weighted by the number of samples
+// in each bin, of the absolute difference between the mean predicted probability and the
+// fraction of positive outcomes, over bins of equal width.
+func ECE(probs, outcomes []float64, bins int) float64 {
+	meanp, frac, counts := ReliabilityCurve(probs, outcomes, bins)
+	var ret float64
+	for b, c := range counts {
+		if c == 0 {
+			continue
+		}
+		ret += float64(c) * math.Abs(meanp[b]-frac[b])
+	}
+	return ret / float64(len(probs))
+}
@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"math"
+)
+
+// A custom objective. It takes the labels and the raw predictions (the base score plus
+// the tree outputs, before any transformation) and returns the first (grads) and second
+// (hess) derivatives of the loss with respect to each raw prediction. For ensembles with
+// several outputs per sample (such as multi-class classifiers) the labels (one-hot encoded),
+// raw predictions, gradients and hessians are n x k matrices, stored row-major in the
+// slices, i.e., the element for sample i and class j is at i*k+j.
+type ObjectiveFunc func(labels, raw []float64) (grads, hess []float64)
+
+// A custom evaluation metric. It takes the labels and raw predictions, in the same format
+// as ObjectiveFunc, and returns a value for the whole data set. Lower values must
+// mean better fits, as the metric can be used for early stopping.
+type MetricFunc func(labels, raw []float64) float64
+
+// CustomObjective wraps an ObjectiveFunc, and, optionally, a MetricFunc and a
+// transformation, so they can be used as an Objective for single-output ensembles.
+// The labels are taken from the FloatLabels of the DataBunch, or, if those are absent,
+// from its Labels.
+type CustomObjective struct {
+	name      string
+	f         ObjectiveFunc
+	metric    MetricFunc
+	transform func(float64) float64
+}
+
+// Returns a new custom objective with the given name, objective and metric functions,
+// and, optionally, a transformation for the raw predictions (by default, none is applied).
+// The metric can be nil, in which case the Value of the objective is always NaN.
+func NewCustomObjective(name string, f ObjectiveFunc, metric MetricFunc, transform ...func(float64) float64) *CustomObjective {
+	ret := &CustomObjective{name: name, f: f, metric: metric}
+	if len(transform) > 0 {
+		ret.transform = transform[0]
+	}
+	return ret
+}
+
+func (c *CustomObjective) Name() string { return c.name }
+
+func (c *CustomObjective) Transform(raw float64) float64 {
+	if c.transform == nil {
+		return raw
+	}
+	return c.transform(raw)
+}
+
+func (c *CustomObjective) GradHess(D *DataBunch, raw, grads, hess []float64) {
+	g, h := c.f(D.FloatTargets(), raw)
+	copy(grads, g)
+	copy(hess, h)
+}
+
+func (c *CustomObjective) Value(D *DataBunch, raw []float64) float64 {
+	if c.metric == nil {
+		return math.NaN()
+	}
+	return c.metric(D.FloatTargets(), raw)
+}
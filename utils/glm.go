@@ -0,0 +1,172 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+)
+
+// Returns the offset for the i-th data vector in D, i.e. the log of its exposure,
+// or 0 if D has no exposures.
+func (D *DataBunch) offset(i int) float64 {
+	if len(D.Exposure) != len(D.Data) {
+		return 0
+	}
+	return math.Log(D.Exposure[i])
+}
+
+// Returns the expected values (exp(raw+offset)) for the raw predictions and the exposures in D.
+func logLinkMeans(D *DataBunch, raw []float64) []float64 {
+	ret := make([]float64, len(raw))
+	for i, v := range raw {
+		ret[i] = math.Exp(v + D.offset(i))
+	}
+	return ret
+}
+
+// Poisson objective with log link, for counts. The labels (FloatLabels, or Labels)
+// are the counts, and the expected count for a sample is exp(raw)*exposure,
+// where the exposure is taken from D (1 if D has no exposures). The transformed
+// prediction is thus the expected count per unit of exposure.
+type PoissonObj struct {
+}
+
+func (p *PoissonObj) Name() string { return "count:poisson" }
+
+func (p *PoissonObj) Transform(raw float64) float64 { return math.Exp(raw) }
+
+func (p *PoissonObj) GradHess(D *DataBunch, raw, grads, hess []float64) {
+	y := D.FloatTargets()
+	for i, mu := range logLinkMeans(D, raw) {
+		grads[i] = mu - y[i]
+		hess[i] = mu
+	}
+}
+
+// Returns the mean Poisson deviance.
+func (p *PoissonObj) Value(D *DataBunch, raw []float64) float64 {
+	return PoissonDeviance(D.FloatTargets(), logLinkMeans(D, raw))
+}
+
+// Gamma objective with log link, for positive, skewed values such as
+// claim amounts. The expected value for a sample is exp(raw)*exposure, where
+// the exposure is taken from D (1 if D has no exposures).
+type GammaObj struct {
+}
+
+func (g *GammaObj) Name() string { return "reg:gamma" }
+
+func (g *GammaObj) Transform(raw float64) float64 { return math.Exp(raw) }
+
+func (g *GammaObj) GradHess(D *DataBunch, raw, grads, hess []float64) {
+	y := D.FloatTargets()
+	for i, mu := range logLinkMeans(D, raw) {
+		grads[i] = 1 - y[i]/mu
+		hess[i] = y[i] / mu
+	}
+}
+
+// Returns the mean Gamma deviance.
+func (g *GammaObj) Value(D *DataBunch, raw []float64) float64 {
+	return GammaDeviance(D.FloatTargets(), logLinkMeans(D, raw))
+}
+
+// Tweedie objective with log link, for non-negative values with a mass at zero,
+// such as insurance claims (a compound Poisson-Gamma distribution). The Power
+// must be between 1 (Poisson) and 2 (Gamma), exclusive, if it is 0, 1.5 is used.
+// The methods panic for other values, use NewTweedieObj or Check to get an error instead.
+// The expected value for a sample is exp(raw)*exposure, where the exposure is taken
+// from D (1 if D has no exposures).
+type TweedieObj struct {
+	Power float64
+}
+
+// Returns a Tweedie objective with the given power, or an error if the
+// power is not between 1 and 2, exclusive.
+func NewTweedieObj(power float64) (*TweedieObj, error) {
+	if !(power > 1 && power < 2) {
+		return nil, fmt.Errorf("Tweedie power must be between 1 and 2 (exclusive), got %v", power)
+	}
+	return &TweedieObj{Power: power}, nil
+}
+
+func (t *TweedieObj) Name() string { return "reg:tweedie" }
+
+// Returns an error if the power is not valid.
+func (t *TweedieObj) Check() error {
+	if t.Power != 0 && !(t.Power > 1 && t.Power < 2) {
+		return fmt.Errorf("Tweedie power must be between 1 and 2 (exclusive), got %v", t.Power)
+	}
+	return nil
+}
+
+func (t *TweedieObj) Transform(raw float64) float64 { return math.Exp(raw) }
+
+func (t *TweedieObj) power() float64 {
+	if t.Power == 0 {
+		return 1.5
+	}
+	if err := t.Check(); err != nil {
+		panic(err.Error())
+	}
+	return t.Power
+}
+
+func (t *TweedieObj) GradHess(D *DataBunch, raw, grads, hess []float64) {
+	y := D.FloatTargets()
+	p := t.power()
+	for i, v := range raw {
+		eta := v + D.offset(i)
+		a := math.Exp((1 - p) * eta)
+		b := math.Exp((2 - p) * eta)
+		grads[i] = -y[i]*a + b
+		hess[i] = -y[i]*(1-p)*a + (2-p)*b
+	}
+}
+
+// Returns the mean Tweedie deviance.
+func (t *TweedieObj) Value(D *DataBunch, raw []float64) float64 {
+	return TweedieDeviance(D.FloatTargets(), logLinkMeans(D, raw), t.power())
+}
+
+// Returns the mean Poisson deviance for the observed values y and
+// the expected values mu.
+func PoissonDeviance(y, mu []float64) float64 {
+	var ret float64
+	for i, v := range y {
+		d := mu[i] - v
+		if v > 0 {
+			d += v * math.Log(v/mu[i])
+		}
+		ret += 2 * d
+	}
+	return ret / float64(len(y))
+}
+
+// Returns the mean Gamma deviance for the observed (positive) values y
+// and the expected values mu.
+func GammaDeviance(y, mu []float64) float64 {
+	var ret float64
+	for i, v := range y {
+		ret += 2 * (-math.Log(v/mu[i]) + (v-mu[i])/mu[i])
+	}
+	return ret / float64(len(y))
+}
+
+// Returns the mean Tweedie deviance with the given power (which must be between
+// 1 and 2, exclusive) for the observed values y and the expected values mu.
+// Returns NaN for other powers.
+func TweedieDeviance(y, mu []float64, power float64) float64 {
+	p := power
+	if !(p > 1 && p < 2) {
+		return math.NaN()
+	}
+	var ret float64
+	for i, v := range y {
+		d := -v*math.Pow(mu[i], 1-p)/(1-p) + math.Pow(mu[i], 2-p)/(2-p)
+		if v > 0 {
+			d += math.Pow(v, 2-p) / ((1 - p) * (2 - p))
+		}
+		ret += 2 * d
+	}
+	return ret / float64(len(y))
+}
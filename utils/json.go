@@ -21,6 +21,7 @@ type JSONNode struct {
 	Rightid           uint
 	Branches          int
 	Value             float64
+	Values            []float64 `json:",omitempty"` //only for vector-leaf trees
 	XGB               bool
 }
 
@@ -20,6 +20,48 @@ type DataBunch struct {
 	Keys        []string
 	Labels      []int
 	FloatLabels []float64 //for now we keep both
+	Groups      []int     //query (group) id for each data vector, for ranking
+	Times       []float64 //event (or censoring) time for each data vector, for survival analysis
+	Censored    []bool    //true if the data vector was (right-)censored at its time, for survival analysis
+	Exposure    []float64 //exposure for each data vector (its log is used as offset), for count and claims objectives
+	LabelSets   [][]int   //the set of labels of each data vector, for multi-label classification
+}
+
+// Returns the labels of the data bunch as floats. If the bunch has FloatLabels for each
+// data vector, those are returned, otherwise, the (int) Labels are converted.
+func (D *DataBunch) FloatTargets() []float64 {
+	if len(D.FloatLabels) == len(D.Data) {
+		return D.FloatLabels
+	}
+	ret := make([]float64, len(D.Labels))
+	for i, v := range D.Labels {
+		ret[i] = float64(v)
+	}
+	return ret
+}
+
+// Returns the indexes of the data vectors in each query group, with the groups in the order
+// in which they first appear. If the bunch has no groups, all the data belongs to a single one.
+func (D *DataBunch) QueryGroups() [][]int {
+	if len(D.Groups) != len(D.Data) {
+		all := make([]int, len(D.Data))
+		for i := range all {
+			all[i] = i
+		}
+		return [][]int{all}
+	}
+	ret := make([][]int, 0, 2)
+	index := make(map[int]int)
+	for i, v := range D.Groups {
+		g, ok := index[v]
+		if !ok {
+			g = len(ret)
+			index[v] = g
+			ret = append(ret, make([]int, 0, 10))
+		}
+		ret[g] = append(ret[g], i)
+	}
+	return ret
 }
 
 // returns a one-hot-encoded representation of the keys of the data bunch
@@ -32,6 +74,23 @@ func (D *DataBunch) OHELabels() (*mat.Dense, []int) {
 	return oneHotEncodeDense(D.Labels)
 }
 
+// Returns a multi-hot-encoded representation of the label sets of the data bunch,
+// and the different labels, in the order of the columns of the matrix.
+func (D *DataBunch) MultiHotLabels() (*mat.Dense, []int) {
+	de := make([]int, 0, 2)
+	for _, v := range D.LabelSets {
+		de = append(de, v...)
+	}
+	de = distinctElements(de)
+	ret := mat.NewDense(len(D.LabelSets), len(de), nil)
+	for i, v := range D.LabelSets {
+		for _, w := range v {
+			ret.Set(i, slices.Index(de, w), 1.0)
+		}
+	}
+	return ret, de
+}
+
 func (D *DataBunch) getithLabel(i int) int {
 	if len(D.Labels) == len(D.Data) {
 		return D.Labels[i]
@@ -80,8 +139,11 @@ func (D *DataBunch) LibSVM() string {
 
 	}
 	for i, v := range D.Data {
-		dline := make([]string, l+1)
+		dline := make([]string, 1, l+2)
 		dline[0] = fmt.Sprintf("%3d", D.getithLabel(i))
+		if len(D.Groups) == len(D.Data) {
+			dline = append(dline, fmt.Sprintf("qid:%d", D.Groups[i]))
+		}
 		for j, w := range v {
 			s := fmt.Sprintf("%d:%5.4f", j+1, w)
 			dline = append(dline, s)
@@ -95,12 +157,14 @@ func (D *DataBunch) LibSVM() string {
 }
 
 // This is not very good at all, it ignores the main strenght of libSVM format, that you can omit 0 values.
-// It's just a temporary solution to allow some testing
-func parseLibSVMLine(line string, header bool, retstr []string, retflo []float64) (int, []string, []float64, error) {
+// It's just a temporary solution to allow some testing. The query id is returned if present in the line
+// (qid:n), -1 otherwise, so query ids must be non-negative.
+func parseLibSVMLine(line string, header bool, retstr []string, retflo []float64) (int, int, []string, []float64, error) {
 	var rets []string
 	var retf []float64
 	var class int
 	var err error
+	qid := -1
 	fields := strings.Fields(line)
 	if len(retstr) >= len(fields)-1 {
 		rets = retstr[:0]
@@ -111,27 +175,34 @@ func parseLibSVMLine(line string, header bool, retstr []string, retflo []float64
 	if !header {
 		class, err = strconv.Atoi(fields[0])
 		if err != nil {
-			return 0, nil, nil, err
+			return 0, qid, nil, nil, err
 		}
 	}
 	for _, v := range fields[1:] {
 		feats := strings.Split(v, ":")
 		if len(feats) != 2 {
-			return -1, nil, nil, fmt.Errorf("Malformed term: %s", v)
+			return -1, qid, nil, nil, fmt.Errorf("Malformed term: %s", v)
 		}
 		feat := feats[1]
+		if feats[0] == "qid" {
+			qid, err = strconv.Atoi(feat)
+			if err != nil || qid < 0 {
+				return class, -1, nil, nil, fmt.Errorf("Malformed query id: %s", v)
+			}
+			continue
+		}
 		if header {
 			rets = append(rets, feat)
 		} else {
 			val, err := strconv.ParseFloat(feat, 64)
 			if err != nil {
-				return class, nil, nil, err
+				return class, qid, nil, nil, err
 			}
 			retf = append(retf, val)
 		}
 
 	}
-	return class, rets, retf, nil
+	return class, qid, rets, retf, nil
 }
 
 func svmliberror(err error, linenu int, line string) error {
@@ -162,6 +233,9 @@ func ParseLibSVMFromReader(r io.Reader, hasHeader bool) (*DataBunch, error) {
 	var headers []string
 	var data [][]float64 = make([][]float64, 0, 1)
 	var labels []int
+	var groups []int
+	hasgroups := false
+	nogroups := false
 	cont := 0
 	for {
 		//	println("Will read the line", cont+1) ///////
@@ -171,7 +245,7 @@ func ParseLibSVMFromReader(r io.Reader, hasHeader bool) (*DataBunch, error) {
 		}
 		var err error
 		if hasHeader && cont == 0 {
-			_, headers, _, err = parseLibSVMLine(line, true, nil, nil)
+			_, _, headers, _, err = parseLibSVMLine(line, true, nil, nil)
 			if err != nil {
 				return nil, svmliberror(err, cont+1, line)
 			}
@@ -180,13 +254,23 @@ func ParseLibSVMFromReader(r io.Reader, hasHeader bool) (*DataBunch, error) {
 		}
 		t := make([]float64, 0, len(headers))
 		l := 0
-		l, _, t, err = parseLibSVMLine(line, false, nil, nil)
+		qid := -1
+		l, qid, _, t, err = parseLibSVMLine(line, false, nil, nil)
 		if err != nil {
 			return nil, svmliberror(err, cont+1, line)
 
 		}
+		if qid >= 0 {
+			hasgroups = true
+		} else {
+			nogroups = true
+		}
+		if hasgroups && nogroups {
+			return nil, svmliberror(fmt.Errorf("Either all or none of the lines must have a query id"), cont+1, line)
+		}
 		data = append(data, t)
 		labels = append(labels, l)
+		groups = append(groups, qid)
 
 		cont++
 	}
@@ -194,7 +278,10 @@ func ParseLibSVMFromReader(r io.Reader, hasHeader bool) (*DataBunch, error) {
 		return nil, err2
 	}
 
-	return &DataBunch{Data: data, Labels: labels, Keys: headers}, nil
+	if !hasgroups {
+		groups = nil
+	}
+	return &DataBunch{Data: data, Labels: labels, Keys: headers, Groups: groups}, nil
 }
 
 /*
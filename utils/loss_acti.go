@@ -1,7 +1,9 @@
 package utils
 
 import (
+	"fmt"
 	"math"
+	"sort"
 
 	"gonum.org/v1/gonum/floats"
 	"gonum.org/v1/gonum/mat"
@@ -54,6 +56,24 @@ func SoftMaxDense(O, D *mat.Dense) *mat.Dense {
 
 }
 
+// puts in probs the sigmoid (logistic) function of each of the inputs in p.
+// allocates a new slice if probs is nil.
+func Sigmoid(p, probs []float64) []float64 {
+	if probs == nil {
+		probs = make([]float64, len(p))
+	}
+	for i, v := range p {
+		probs[i] = 1 / (1 + math.Exp(-v))
+	}
+	return probs
+}
+
+// puts in D the sigmoid output for the inputs in O.
+// allocates a new matrix if D is nil.
+func SigmoidDense(O, D *mat.Dense) *mat.Dense {
+	return activationDense(O, D, Sigmoid)
+}
+
 // Applies the activation function given to each row of the O matrix to fill the D matrix
 // and returns D. If nil is given for the D matrix, a new one is allocated.
 func activationDense(O, D *mat.Dense, activation func([]float64, []float64) []float64) *mat.Dense {
@@ -79,6 +99,21 @@ type LossFunc interface {
 	Hessian(*mat.Dense, *mat.Dense) *mat.Dense
 }
 
+// Interface for the training objectives of ensembles that produce one value
+// per sample (regression, ranking, etc.), as opposed to the one-hot-encoded
+// multi-class classification for which LossFunc is used. The raw predictions
+// are the base score plus the tree outputs, before any transformation.
+type Objective interface {
+	Name() string
+	//Fills grads and hess with the first and second derivatives of the loss with respect
+	//to the raw prediction for each sample in D.
+	GradHess(D *DataBunch, raw, grads, hess []float64)
+	//Returns the loss for the whole data set.
+	Value(D *DataBunch, raw []float64) float64
+	//Transforms a raw prediction into the final prediction.
+	Transform(raw float64) float64
+}
+
 // Square error
 type SQErrLoss struct {
 }
@@ -196,3 +231,281 @@ func (m *MSELoss) Hessian(probabilities, hessian *mat.Dense) *mat.Dense {
 	}
 	return hessian
 }
+
+// Interface for the objectives with parameters that can be wrong, which are checked
+// before the training starts.
+type Checker interface {
+	//Returns an error if the parameters are not valid.
+	Check() error
+}
+
+// Interface for the losses for which the leaf values in regular gradient boosting
+// are not a Newton step, but need to be obtained from the residuals (labels minus
+// current predictions) of the samples in each leaf, like the quantile loss.
+type LeafUpdater interface {
+	//Returns the value for a leaf, given the residuals of its samples. The residuals
+	//slice may be modified.
+	LeafValue(residuals []float64) float64
+}
+
+// Returns the alpha-quantile of the values in x, interpolating linearly
+// between the closest ranks. x is sorted in place.
+func Quantile(x []float64, alpha float64) float64 {
+	if len(x) == 0 {
+		return 0
+	}
+	sort.Float64s(x)
+	pos := alpha * float64(len(x)-1)
+	lo := int(math.Floor(pos))
+	hi := int(math.Ceil(pos))
+	return x[lo] + (pos-float64(lo))*(x[hi]-x[lo])
+}
+
+// Applies the residual function f to each pair of label and prediction and fills results
+// with the output. Allocates results if nil.
+func residualDense(y, pred, results *mat.Dense, f func(float64) float64) *mat.Dense {
+	if results == nil {
+		r, c := y.Dims()
+		results = mat.NewDense(r, c, nil)
+	}
+	results.Sub(y, pred)
+	raw := results.RawMatrix().Data
+	for i, v := range raw {
+		raw[i] = f(v)
+	}
+	return results
+}
+
+// Returns the mean of the residual function f over the labels in D and the given predictions
+func residualMean(D *DataBunch, pred []float64, f func(float64) float64) float64 {
+	y := D.FloatTargets()
+	var l float64
+	for i, v := range y {
+		l += f(v - pred[i])
+	}
+	return l / float64(len(y))
+}
+
+// Fills grads with the gradient functions for the residuals of the labels in D and the
+// given predictions, and hess with the hessian function. The hessian function can be nil,
+// in which case hess is filled with ones.
+func residualGradHess(D *DataBunch, pred, grads, hess []float64, neggrad, hessian func(float64) float64) {
+	y := D.FloatTargets()
+	for i, v := range y {
+		r := v - pred[i]
+		grads[i] = -neggrad(r)
+		hess[i] = 1
+		if hessian != nil {
+			hess[i] = hessian(r)
+		}
+	}
+}
+
+// Huber loss. Squared error for residuals smaller (in absolute value) than Delta,
+// absolute error for larger ones. The Hessian is taken as 1.0 everywhere.
+// Implements both LossFunc and Objective (the latter with no transformation).
+type HuberLoss struct {
+	Delta float64
+}
+
+func (h *HuberLoss) Name() string { return "huber" }
+
+func (h *HuberLoss) loss(r float64) float64 {
+	if math.Abs(r) <= h.Delta {
+		return 0.5 * r * r
+	}
+	return h.Delta * (math.Abs(r) - 0.5*h.Delta)
+}
+
+func (h *HuberLoss) negGrad(r float64) float64 {
+	if math.Abs(r) <= h.Delta {
+		return r
+	}
+	return h.Delta * math.Copysign(1, r)
+}
+
+func (h *HuberLoss) Loss(y, pred, loss *mat.Dense) float64 {
+	loss = residualDense(y, pred, loss, h.loss)
+	return floats.Sum(loss.RawMatrix().Data) / float64(len(loss.RawMatrix().Data))
+}
+
+// Returns the results matrix filled witht he negative gradients.
+// if a nil results is given, it will allocate a new matrix and return it.
+func (h *HuberLoss) NegGradients(y, pred, results *mat.Dense) *mat.Dense {
+	return residualDense(y, pred, results, h.negGrad)
+}
+
+// Returns the results matrix filled with the gradients.
+// if a nil results is given, it will allocate a new matrix and return it.
+func (h *HuberLoss) Gradients(y, pred, results *mat.Dense) *mat.Dense {
+	g := h.NegGradients(y, pred, results)
+	g.Scale(-1, g)
+	return g
+}
+
+// Returns the hessian matrix filled with ones.
+// if a nil hessian is given, it will allocate a new matrix and return it.
+func (h *HuberLoss) Hessian(pred, hessian *mat.Dense) *mat.Dense {
+	r, c := pred.Dims()
+	if hessian == nil {
+		hessian = mat.NewDense(r, c, nil)
+	}
+	ToOnes(hessian)
+	return hessian
+}
+
+func (h *HuberLoss) GradHess(D *DataBunch, raw, grads, hess []float64) {
+	residualGradHess(D, raw, grads, hess, h.negGrad, nil)
+}
+
+func (h *HuberLoss) Value(D *DataBunch, raw []float64) float64 {
+	return residualMean(D, raw, h.loss)
+}
+
+func (h *HuberLoss) Transform(raw float64) float64 { return raw }
+
+// The leaf value is the median of the residuals plus the mean of their
+// deviations from it, clipped to Delta (as in Friedman's M-regression).
+func (h *HuberLoss) LeafValue(residuals []float64) float64 {
+	if len(residuals) == 0 {
+		return 0
+	}
+	med := Quantile(residuals, 0.5)
+	var s float64
+	for _, v := range residuals {
+		d := v - med
+		s += math.Copysign(math.Min(math.Abs(d), h.Delta), d)
+	}
+	return med + s/float64(len(residuals))
+}
+
+// Pseudo-Huber loss: Delta^2*(sqrt(1+(r/Delta)^2)-1), for residual r. A smooth
+// approximation to the Huber loss. As the LossFunc interface doesn't give the labels
+// to the Hessian method, it returns ones, but the Objective methods use the actual hessian.
+type PseudoHuberLoss struct {
+	Delta float64
+}
+
+func (h *PseudoHuberLoss) Name() string { return "pseudohuber" }
+
+func (h *PseudoHuberLoss) loss(r float64) float64 {
+	q := r / h.Delta
+	return h.Delta * h.Delta * (math.Sqrt(1+q*q) - 1)
+}
+
+func (h *PseudoHuberLoss) negGrad(r float64) float64 {
+	q := r / h.Delta
+	return r / math.Sqrt(1+q*q)
+}
+
+func (h *PseudoHuberLoss) hessian(r float64) float64 {
+	q := r / h.Delta
+	return 1 / math.Pow(1+q*q, 1.5)
+}
+
+func (h *PseudoHuberLoss) Loss(y, pred, loss *mat.Dense) float64 {
+	loss = residualDense(y, pred, loss, h.loss)
+	return floats.Sum(loss.RawMatrix().Data) / float64(len(loss.RawMatrix().Data))
+}
+
+// Returns the results matrix filled witht he negative gradients.
+// if a nil results is given, it will allocate a new matrix and return it.
+func (h *PseudoHuberLoss) NegGradients(y, pred, results *mat.Dense) *mat.Dense {
+	return residualDense(y, pred, results, h.negGrad)
+}
+
+// Returns the results matrix filled with the gradients.
+// if a nil results is given, it will allocate a new matrix and return it.
+func (h *PseudoHuberLoss) Gradients(y, pred, results *mat.Dense) *mat.Dense {
+	g := h.NegGradients(y, pred, results)
+	g.Scale(-1, g)
+	return g
+}
+
+// Returns the hessian matrix filled with ones.
+// if a nil hessian is given, it will allocate a new matrix and return it.
+func (h *PseudoHuberLoss) Hessian(pred, hessian *mat.Dense) *mat.Dense {
+	r, c := pred.Dims()
+	if hessian == nil {
+		hessian = mat.NewDense(r, c, nil)
+	}
+	ToOnes(hessian)
+	return hessian
+}
+
+func (h *PseudoHuberLoss) GradHess(D *DataBunch, raw, grads, hess []float64) {
+	residualGradHess(D, raw, grads, hess, h.negGrad, h.hessian)
+}
+
+func (h *PseudoHuberLoss) Value(D *DataBunch, raw []float64) float64 {
+	return residualMean(D, raw, h.loss)
+}
+
+func (h *PseudoHuberLoss) Transform(raw float64) float64 { return raw }
+
+// Quantile (pinball) loss, for the Alpha quantile (say, 0.9 for P90).
+// The Hessian is taken as 1.0 everywhere. In regular gradient boosting the leaf
+// values are the Alpha quantiles of the residuals in each leaf.
+type QuantileLoss struct {
+	Alpha float64
+}
+
+func (q *QuantileLoss) Name() string { return fmt.Sprintf("quantile%.2f", q.Alpha) }
+
+func (q *QuantileLoss) loss(r float64) float64 {
+	if r >= 0 {
+		return q.Alpha * r
+	}
+	return (q.Alpha - 1) * r
+}
+
+func (q *QuantileLoss) negGrad(r float64) float64 {
+	if r >= 0 {
+		return q.Alpha
+	}
+	return q.Alpha - 1
+}
+
+func (q *QuantileLoss) Loss(y, pred, loss *mat.Dense) float64 {
+	loss = residualDense(y, pred, loss, q.loss)
+	return floats.Sum(loss.RawMatrix().Data) / float64(len(loss.RawMatrix().Data))
+}
+
+// Returns the results matrix filled witht he negative gradients.
+// if a nil results is given, it will allocate a new matrix and return it.
+func (q *QuantileLoss) NegGradients(y, pred, results *mat.Dense) *mat.Dense {
+	return residualDense(y, pred, results, q.negGrad)
+}
+
+// Returns the results matrix filled with the gradients.
+// if a nil results is given, it will allocate a new matrix and return it.
+func (q *QuantileLoss) Gradients(y, pred, results *mat.Dense) *mat.Dense {
+	g := q.NegGradients(y, pred, results)
+	g.Scale(-1, g)
+	return g
+}
+
+// Returns the hessian matrix filled with ones.
+// if a nil hessian is given, it will allocate a new matrix and return it.
+func (q *QuantileLoss) Hessian(pred, hessian *mat.Dense) *mat.Dense {
+	r, c := pred.Dims()
+	if hessian == nil {
+		hessian = mat.NewDense(r, c, nil)
+	}
+	ToOnes(hessian)
+	return hessian
+}
+
+func (q *QuantileLoss) GradHess(D *DataBunch, raw, grads, hess []float64) {
+	residualGradHess(D, raw, grads, hess, q.negGrad, nil)
+}
+
+func (q *QuantileLoss) Value(D *DataBunch, raw []float64) float64 {
+	return residualMean(D, raw, q.loss)
+}
+
+func (q *QuantileLoss) Transform(raw float64) float64 { return raw }
+
+func (q *QuantileLoss) LeafValue(residuals []float64) float64 {
+	return Quantile(residuals, q.Alpha)
+}
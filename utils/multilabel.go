@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"slices"
+)
+
+// Returns the Hamming loss between the actual and predicted label sets, given all the
+// possible labels: the fraction of (sample, label) pairs that are wrongly predicted.
+func HammingLoss(actual, predicted [][]int, labels []int) float64 {
+	wrong := 0
+	for i, a := range actual {
+		for _, l := range labels {
+			if slices.Contains(a, l) != slices.Contains(predicted[i], l) {
+				wrong++
+			}
+		}
+	}
+	return float64(wrong) / float64(len(actual)*len(labels))
+}
+
+// Returns the subset accuracy: the fraction of samples for which the predicted label
+// set is exactly the actual one.
+func SubsetAccuracy(actual, predicted [][]int) float64 {
+	right := 0
+	for i, a := range actual {
+		if len(a) != len(predicted[i]) {
+			continue
+		}
+		same := true
+		for _, l := range a {
+			if !slices.Contains(predicted[i], l) {
+				same = false
+				break
+			}
+		}
+		if same {
+			right++
+		}
+	}
+	return float64(right) / float64(len(actual))
+}
+
+// Returns the true positives, false positives and false negatives for the
+// label l.
+func labelCounts(actual, predicted [][]int, l int) (int, int, int) {
+	var tp, fp, fn int
+	for i, a := range actual {
+		ina := slices.Contains(a, l)
+		inp := slices.Contains(predicted[i], l)
+		switch {
+		case ina && inp:
+			tp++
+		case inp:
+			fp++
+		case ina:
+			fn++
+		}
+	}
+	return tp, fp, fn
+}
+
+// Returns the micro-averaged F1 score, where the true/false positives and
+// the false negatives are pooled over all the labels.
+func MicroF1(actual, predicted [][]int, labels []int) float64 {
+	var tp, fp, fn int
+	for _, l := range labels {
+		t, p, n := labelCounts(actual, predicted, l)
+		tp += t
+		fp += p
+		fn += n
+	}
+	if tp+fp+fn == 0 {
+		return 1
+	}
+	return 2 * float64(tp) / float64(2*tp+fp+fn)
+}
+
+// Returns the macro-averaged F1 score, i.e., the mean of the F1 scores for each
+// label. Labels that are neither present nor predicted in any sample are not
+// considered.
+func MacroF1(actual, predicted [][]int, labels []int) float64 {
+	var sum float64
+	n := 0
+	for _, l := range labels {
+		tp, fp, fn := labelCounts(actual, predicted, l)
+		if tp+fp+fn == 0 {
+			continue
+		}
+		sum += 2 * float64(tp) / float64(2*tp+fp+fn)
+		n++
+	}
+	if n == 0 {
+		return 1
+	}
+	return sum / float64(n)
+}
@@ -0,0 +1,213 @@
+package utils
+
+import (
+	"math"
+	"sort"
+)
+
+// Pairwise (RankNet) learning-to-rank objective. For each pair of samples in a
+// query group with different relevance, the logistic loss of the difference
+// between their scores is minimized. The relevance is taken from the
+// labels of the DataBunch and the query groups from its Groups.
+type PairwiseRank struct {
+}
+
+func (p *PairwiseRank) Name() string { return "rank:pairwise" }
+
+func (p *PairwiseRank) Transform(raw float64) float64 { return raw }
+
+func (p *PairwiseRank) GradHess(D *DataBunch, raw, grads, hess []float64) {
+	pairGradHess(D, raw, grads, hess, nil)
+}
+
+// Returns the mean logistic loss over all the pairs with different relevance.
+func (p *PairwiseRank) Value(D *DataBunch, raw []float64) float64 {
+	rel := D.FloatTargets()
+	var loss float64
+	n := 0
+	for _, g := range D.QueryGroups() {
+		for _, i := range g {
+			for _, j := range g {
+				if rel[i] <= rel[j] {
+					continue
+				}
+				loss += math.Log1p(math.Exp(raw[j] - raw[i]))
+				n++
+			}
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return loss / float64(n)
+}
+
+// LambdaMART learning-to-rank objective. Like the pairwise objective, but
+// each pair is weighted by the change in NDCG@K that swapping the pair would produce
+// in the current ranking. If K is 0, the whole ranking is considered. The relevance
+// is taken from the labels of the DataBunch and the query groups from its Groups.
+type LambdaRank struct {
+	K int
+}
+
+func (l *LambdaRank) Name() string { return "rank:ndcg" }
+
+func (l *LambdaRank) Transform(raw float64) float64 { return raw }
+
+func (l *LambdaRank) GradHess(D *DataBunch, raw, grads, hess []float64) {
+	pairGradHess(D, raw, grads, hess, l)
+}
+
+// Returns 1-NDCG@K, averaged over the query groups.
+func (l *LambdaRank) Value(D *DataBunch, raw []float64) float64 {
+	return 1 - MeanNDCG(D, raw, l.K)
+}
+
+// Fills grads and hess for the pairwise objective. If lambda is not nil, each
+// pair is weighted by the absolute change in NDCG produced by swapping it.
+func pairGradHess(D *DataBunch, raw, grads, hess []float64, lambda *LambdaRank) {
+	rel := D.FloatTargets()
+	for i := range grads {
+		grads[i] = 0
+		hess[i] = 0
+	}
+	for _, g := range D.QueryGroups() {
+		var pos []int
+		var idcg float64
+		if lambda != nil {
+			pos = ranks(g, raw)
+			idcg = idealDCG(SampleSlice(rel, g), lambda.K)
+			if idcg == 0 {
+				continue //all-irrelevant groups don't contribute
+			}
+		}
+		for a, i := range g {
+			for b, j := range g {
+				if rel[i] <= rel[j] {
+					continue
+				}
+				w := 1.0
+				if lambda != nil {
+					delta := (gain(rel[i]) - gain(rel[j])) * (discount(pos[a], lambda.K) - discount(pos[b], lambda.K))
+					w = math.Abs(delta) / idcg
+				}
+				p := 1 / (1 + math.Exp(raw[j]-raw[i])) //probability of i ranked over j
+				grads[i] -= w * (1 - p)
+				grads[j] += w * (1 - p)
+				h := w * p * (1 - p)
+				hess[i] += h
+				hess[j] += h
+			}
+		}
+	}
+}
+
+// Returns the (zero-based) position of each of the samples with the given indexes
+// in the ranking produced by sorting them by decreasing score.
+func ranks(indexes []int, scores []float64) []int {
+	order := rankOrder(indexes, scores)
+	ret := make([]int, len(indexes))
+	for p, v := range order {
+		ret[v] = p
+	}
+	return ret
+}
+
+// Returns the positions in indexes of the samples, sorted by decreasing score.
+func rankOrder(indexes []int, scores []float64) []int {
+	order := make([]int, len(indexes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return scores[indexes[order[a]]] > scores[indexes[order[b]]] })
+	return order
+}
+
+func gain(rel float64) float64 {
+	return math.Exp2(rel) - 1
+}
+
+// The DCG discount for the zero-based position pos, zero beyond the
+// truncation k (if k > 0).
+func discount(pos, k int) float64 {
+	if k > 0 && pos >= k {
+		return 0
+	}
+	return 1 / math.Log2(float64(pos)+2)
+}
+
+func idealDCG(rel []float64, k int) float64 {
+	sorted := make([]float64, len(rel))
+	copy(sorted, rel)
+	sort.Sort(sort.Reverse(sort.Float64Slice(sorted)))
+	var ret float64
+	for i, v := range sorted {
+		ret += gain(v) * discount(i, k)
+	}
+	return ret
+}
+
+// Returns the normalized discounted cumulative gain at k (NDCG@k) of the ranking
+// produced by sorting the samples by decreasing score, given their relevance.
+// If k is 0, the whole ranking is considered. Returns 1 if there are
+// no relevant samples.
+func NDCG(relevance, scores []float64, k int) float64 {
+	indexes := make([]int, len(scores))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	idcg := idealDCG(relevance, k)
+	if idcg == 0 {
+		return 1
+	}
+	var dcg float64
+	for p, v := range rankOrder(indexes, scores) {
+		dcg += gain(relevance[v]) * discount(p, k)
+	}
+	return dcg / idcg
+}
+
+// Returns the average precision of the ranking produced by sorting the samples by
+// decreasing score. Samples with relevance larger than 0 are considered relevant.
+// Returns 1 if there are no relevant samples.
+func AveragePrecision(relevance, scores []float64) float64 {
+	indexes := make([]int, len(scores))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	var hits, sum float64
+	for p, v := range rankOrder(indexes, scores) {
+		if relevance[v] > 0 {
+			hits++
+			sum += hits / float64(p+1)
+		}
+	}
+	if hits == 0 {
+		return 1
+	}
+	return sum / hits
+}
+
+// Returns the NDCG@k averaged over the query groups in D, for the given scores
+// (one per sample in D). The relevances are the labels in D.
+func MeanNDCG(D *DataBunch, scores []float64, k int) float64 {
+	rel := D.FloatTargets()
+	groups := D.QueryGroups()
+	var ret float64
+	for _, g := range groups {
+		ret += NDCG(SampleSlice(rel, g), SampleSlice(scores, g), k)
+	}
+	return ret / float64(len(groups))
+}
+
+// Returns the mean average precision (MAP) over the query groups in D, for
+// the given scores (one per sample in D). The relevances are the labels in D.
+func MeanAP(D *DataBunch, scores []float64) float64 {
+	rel := D.FloatTargets()
+	groups := D.QueryGroups()
+	var ret float64
+	for _, g := range groups {
+		ret += AveragePrecision(SampleSlice(rel, g), SampleSlice(scores, g))
+	}
+	return ret / float64(len(groups))
+}
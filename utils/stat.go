@@ -26,6 +26,21 @@ func isInPrevious(i int, sam [][]int) bool {
 func fillDataBunch(ori, dest *DataBunch, toadd []int, docopy bool) *DataBunch {
 	dest.Data = make([][]float64, 0, len(toadd))
 	dest.Labels = make([]int, 0, len(toadd))
+	if len(ori.Groups) == len(ori.Data) {
+		dest.Groups = make([]int, 0, len(toadd))
+	}
+	if len(ori.Times) == len(ori.Data) {
+		dest.Times = make([]float64, 0, len(toadd))
+	}
+	if len(ori.Censored) == len(ori.Data) {
+		dest.Censored = make([]bool, 0, len(toadd))
+	}
+	if len(ori.Exposure) == len(ori.Data) {
+		dest.Exposure = make([]float64, 0, len(toadd))
+	}
+	if len(ori.LabelSets) == len(ori.Data) {
+		dest.LabelSets = make([][]int, 0, len(toadd))
+	}
 
 	for _, v := range toadd {
 		var add []float64
@@ -39,6 +54,21 @@ func fillDataBunch(ori, dest *DataBunch, toadd []int, docopy bool) *DataBunch {
 		if len(ori.Labels) > v {
 			dest.Labels = append(dest.Labels, ori.Labels[v])
 		}
+		if dest.Groups != nil {
+			dest.Groups = append(dest.Groups, ori.Groups[v])
+		}
+		if dest.Times != nil {
+			dest.Times = append(dest.Times, ori.Times[v])
+		}
+		if dest.Censored != nil {
+			dest.Censored = append(dest.Censored, ori.Censored[v])
+		}
+		if dest.Exposure != nil {
+			dest.Exposure = append(dest.Exposure, ori.Exposure[v])
+		}
+		if dest.LabelSets != nil {
+			dest.LabelSets = append(dest.LabelSets, slices.Clone(ori.LabelSets[v]))
+		}
 	}
 	if len(dest.Keys) > 0 {
 		if docopy {
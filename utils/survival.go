@@ -0,0 +1,197 @@
+package utils
+
+import (
+	"math"
+	"sort"
+)
+
+// returns true if the i-th data vector in D is censored.
+func (D *DataBunch) censored(i int) bool {
+	return len(D.Censored) == len(D.Data) && D.Censored[i]
+}
+
+// Cox proportional hazards objective, using Breslow's method for the ties.
+// The event times and censoring flags are taken from the Times and Censored
+// fields of the DataBunch (if there is no Censored field, all samples are
+// considered events). The raw predictions are log hazard ratios, and the
+// transformed predictions, the hazard ratios.
+type CoxPH struct {
+}
+
+func (c *CoxPH) Name() string { return "survival:cox" }
+
+func (c *CoxPH) Transform(raw float64) float64 { return math.Exp(raw) }
+
+// Returns the sample indexes sorted by increasing time, and, for each position in
+// that order, the position of the first sample with the same time.
+func timeOrder(D *DataBunch) ([]int, []int) {
+	order := make([]int, len(D.Times))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return D.Times[order[a]] < D.Times[order[b]] })
+	first := make([]int, len(order))
+	for p := range order {
+		if p > 0 && D.Times[order[p]] == D.Times[order[p-1]] {
+			first[p] = first[p-1]
+		} else {
+			first[p] = p
+		}
+	}
+	return order, first
+}
+
+// Returns, for each position in the order given, the sum of exp(raw) over the
+// risk set, i.e. the samples with times not smaller than the one at that position.
+func riskSums(raw []float64, order, first []int) []float64 {
+	suffix := make([]float64, len(order)+1)
+	for p := len(order) - 1; p >= 0; p-- {
+		suffix[p] = suffix[p+1] + math.Exp(raw[order[p]])
+	}
+	ret := make([]float64, len(order))
+	for p := range order {
+		ret[p] = suffix[first[p]]
+	}
+	return ret
+}
+
+func (c *CoxPH) GradHess(D *DataBunch, raw, grads, hess []float64) {
+	order, first := timeOrder(D)
+	s := riskSums(raw, order, first)
+	var a, b float64 //cumulative sums of 1/S and 1/S^2 over the events so far
+	for p := 0; p < len(order); {
+		//all samples with the same time are processed together
+		end := p
+		for end < len(order) && first[end] == first[p] {
+			if !D.censored(order[end]) {
+				a += 1 / s[end]
+				b += 1 / (s[end] * s[end])
+			}
+			end++
+		}
+		for q := p; q < end; q++ {
+			i := order[q]
+			e := math.Exp(raw[i])
+			grads[i] = e * a
+			if !D.censored(i) {
+				grads[i]--
+			}
+			hess[i] = e*a - e*e*b
+		}
+		p = end
+	}
+}
+
+// Returns the negative partial log-likelihood, divided by the number of events.
+func (c *CoxPH) Value(D *DataBunch, raw []float64) float64 {
+	order, first := timeOrder(D)
+	s := riskSums(raw, order, first)
+	var ret float64
+	events := 0
+	for p, i := range order {
+		if D.censored(i) {
+			continue
+		}
+		ret -= raw[i] - math.Log(s[p])
+		events++
+	}
+	if events == 0 {
+		return 0
+	}
+	return ret / float64(events)
+}
+
+// Accelerated failure time objective, with right censoring. The logarithm of the
+// event time is modeled as the raw prediction plus a normally-distributed error with
+// standard deviation Sigma (1, if Sigma is 0). The event times and censoring flags are
+// taken from the Times and Censored fields of the DataBunch. The transformed
+// predictions are the predicted (median) event times.
+type AFT struct {
+	Sigma float64
+}
+
+func (a *AFT) Name() string { return "survival:aft" }
+
+func (a *AFT) Transform(raw float64) float64 { return math.Exp(raw) }
+
+func (a *AFT) sigma() float64 {
+	if a.Sigma <= 0 {
+		return 1
+	}
+	return a.Sigma
+}
+
+// Returns the standardized residual for sample i
+func (a *AFT) z(D *DataBunch, raw []float64, i int) float64 {
+	return (math.Log(D.Times[i]) - raw[i]) / a.sigma()
+}
+
+// hazard function (pdf/survival) of the standard normal distribution.
+func normalHazard(z float64) float64 {
+	surv := 0.5 * math.Erfc(z/math.Sqrt2)
+	pdf := math.Exp(-0.5*z*z) / math.Sqrt(2*math.Pi)
+	if surv < 1e-300 {
+		return z //asymptotic value
+	}
+	return pdf / surv
+}
+
+func (a *AFT) GradHess(D *DataBunch, raw, grads, hess []float64) {
+	s := a.sigma()
+	for i := range raw {
+		z := a.z(D, raw, i)
+		if D.censored(i) {
+			h := normalHazard(z)
+			grads[i] = -h / s
+			hess[i] = math.Max(h*(h-z)/(s*s), 1e-16)
+		} else {
+			grads[i] = -z / s
+			hess[i] = 1 / (s * s)
+		}
+	}
+}
+
+// Returns the mean negative log-likelihood.
+func (a *AFT) Value(D *DataBunch, raw []float64) float64 {
+	s := a.sigma()
+	var ret float64
+	for i := range raw {
+		z := a.z(D, raw, i)
+		if D.censored(i) {
+			ret -= math.Log(math.Max(0.5*math.Erfc(z/math.Sqrt2), 1e-300))
+		} else {
+			ret += 0.5*z*z + math.Log(s*D.Times[i]*math.Sqrt(2*math.Pi))
+		}
+	}
+	return ret / float64(len(raw))
+}
+
+// Returns Harrell's concordance index for the given risk scores (one per data vector in D,
+// larger risks meaning earlier events, such as the hazard ratios from CoxPH, or the
+// negative of the predicted times from AFT). Only pairs where the sample with the shorter time
+// had an event are comparable. Ties in the risk count as half-concordant.
+// Returns -1 if there are no comparable pairs.
+func ConcordanceIndex(D *DataBunch, risk []float64) float64 {
+	var concordant float64
+	comparable := 0
+	for i, ti := range D.Times {
+		if D.censored(i) {
+			continue
+		}
+		for j, tj := range D.Times {
+			if ti >= tj {
+				continue
+			}
+			comparable++
+			if risk[i] > risk[j] {
+				concordant++
+			} else if risk[i] == risk[j] {
+				concordant += 0.5
+			}
+		}
+	}
+	if comparable == 0 {
+		return -1
+	}
+	return concordant / float64(comparable)
+}
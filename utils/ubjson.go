@@ -0,0 +1,312 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// Decodes a Universal Binary JSON (UBJSON) document, such as the .ubj models written
+// by XGBoost. Objects are returned as map[string]any, arrays as []any, integers as int64,
+// floating point numbers as float64, and strings, booleans and nulls as the corresponding
+// Go values. High-precision numbers are returned as strings.
+func DecodeUBJSON(r io.Reader) (any, error) {
+	br := bufio.NewReader(r)
+	m, err := ubjMarker(br)
+	if err != nil {
+		return nil, err
+	}
+	return ubjValue(br, m)
+}
+
+// Returns the next marker, skipping no-ops.
+func ubjMarker(r *bufio.Reader) (byte, error) {
+	for {
+		m, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if m != 'N' {
+			return m, nil
+		}
+	}
+}
+
+func ubjValue(r *bufio.Reader, marker byte) (any, error) {
+	var err error
+	switch marker {
+	case 'Z':
+		return nil, nil
+	case 'T':
+		return true, nil
+	case 'F':
+		return false, nil
+	case 'i':
+		var v int8
+		err = binary.Read(r, binary.BigEndian, &v)
+		return int64(v), err
+	case 'U':
+		var v uint8
+		err = binary.Read(r, binary.BigEndian, &v)
+		return int64(v), err
+	case 'I':
+		var v int16
+		err = binary.Read(r, binary.BigEndian, &v)
+		return int64(v), err
+	case 'l':
+		var v int32
+		err = binary.Read(r, binary.BigEndian, &v)
+		return int64(v), err
+	case 'L':
+		var v int64
+		err = binary.Read(r, binary.BigEndian, &v)
+		return v, err
+	case 'd':
+		var v float32
+		err = binary.Read(r, binary.BigEndian, &v)
+		return float64(v), err
+	case 'D':
+		var v float64
+		err = binary.Read(r, binary.BigEndian, &v)
+		return v, err
+	case 'C':
+		c, err := r.ReadByte()
+		return string([]byte{c}), err
+	case 'S', 'H':
+		return ubjString(r)
+	case '[':
+		return ubjArray(r)
+	case '{':
+		return ubjObject(r)
+	}
+	return nil, fmt.Errorf("Unknown UBJSON marker %q", marker)
+}
+
+// Reads an integer (used for lengths and counts).
+func ubjInt(r *bufio.Reader) (int, error) {
+	m, err := ubjMarker(r)
+	if err != nil {
+		return 0, err
+	}
+	v, err := ubjValue(r, m)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := v.(int64)
+	if !ok || n < 0 {
+		return 0, fmt.Errorf("Invalid UBJSON length %v", v)
+	}
+	return int(n), nil
+}
+
+func ubjString(r *bufio.Reader) (string, error) {
+	n, err := ubjInt(r)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return string(b), err
+}
+
+// Reads the optional type and count of a container. Returns a 0 type if
+// there is none and a -1 count if there is none.
+func ubjContainerHeader(r *bufio.Reader) (byte, int, error) {
+	var typ byte
+	count := -1
+	p, err := r.Peek(1)
+	if err != nil {
+		return 0, 0, err
+	}
+	if p[0] == '$' {
+		r.ReadByte()
+		if typ, err = r.ReadByte(); err != nil {
+			return 0, 0, err
+		}
+		p, err = r.Peek(1)
+		if err != nil {
+			return 0, 0, err
+		}
+		if p[0] != '#' {
+			return 0, 0, fmt.Errorf("UBJSON container type without count")
+		}
+	}
+	if p[0] == '#' {
+		r.ReadByte()
+		if count, err = ubjInt(r); err != nil {
+			return 0, 0, err
+		}
+	}
+	return typ, count, nil
+}
+
+func ubjArray(r *bufio.Reader) (any, error) {
+	typ, count, err := ubjContainerHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]any, 0, max(count, 0))
+	for i := 0; count < 0 || i < count; i++ {
+		m := typ
+		if m == 0 {
+			if m, err = ubjMarker(r); err != nil {
+				return nil, err
+			}
+			if m == ']' && count < 0 {
+				break
+			}
+		}
+		v, err := ubjValue(r, m)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, v)
+	}
+	return ret, nil
+}
+
+func ubjObject(r *bufio.Reader) (any, error) {
+	typ, count, err := ubjContainerHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]any)
+	for i := 0; count < 0 || i < count; i++ {
+		if count < 0 {
+			p, err := r.Peek(1)
+			if err != nil {
+				return nil, err
+			}
+			if p[0] == '}' {
+				r.ReadByte()
+				break
+			}
+		}
+		key, err := ubjString(r)
+		if err != nil {
+			return nil, err
+		}
+		m := typ
+		if m == 0 {
+			if m, err = ubjMarker(r); err != nil {
+				return nil, err
+			}
+		}
+		v, err := ubjValue(r, m)
+		if err != nil {
+			return nil, err
+		}
+		ret[key] = v
+	}
+	return ret, nil
+}
+
+// Encodes v as Universal Binary JSON. v can contain maps with string keys (map[string]any),
+// slices of any, float64, float32, int, int32 and uint8, and strings, booleans, nil and numbers of those types.
+// Integers are written as int64, float64 as float64 and float32 as float32 values. Slices of numbers
+// are written as optimized (typed) arrays. Map keys are sorted.
+func MarshalUBJSON(v any) ([]byte, error) {
+	b := new(bytes.Buffer)
+	err := ubjWrite(b, v)
+	return b.Bytes(), err
+}
+
+func ubjWriteString(b *bytes.Buffer, s string) {
+	ubjWriteInt(b, int64(len(s)))
+	b.WriteString(s)
+}
+
+// Writes an integer with the smallest type that can contain it.
+func ubjWriteInt(b *bytes.Buffer, n int64) {
+	switch {
+	case n >= math.MinInt8 && n <= math.MaxInt8:
+		b.WriteByte('i')
+		b.WriteByte(byte(int8(n)))
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		b.WriteByte('I')
+		binary.Write(b, binary.BigEndian, int16(n))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		b.WriteByte('l')
+		binary.Write(b, binary.BigEndian, int32(n))
+	default:
+		b.WriteByte('L')
+		binary.Write(b, binary.BigEndian, n)
+	}
+}
+
+func ubjWrite(b *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case nil:
+		b.WriteByte('Z')
+	case bool:
+		if v {
+			b.WriteByte('T')
+		} else {
+			b.WriteByte('F')
+		}
+	case int:
+		ubjWriteInt(b, int64(v))
+	case int64:
+		ubjWriteInt(b, v)
+	case float32:
+		b.WriteByte('d')
+		binary.Write(b, binary.BigEndian, v)
+	case float64:
+		b.WriteByte('D')
+		binary.Write(b, binary.BigEndian, v)
+	case string:
+		b.WriteByte('S')
+		ubjWriteString(b, v)
+	case []float32:
+		b.WriteString("[$d#")
+		ubjWriteInt(b, int64(len(v)))
+		binary.Write(b, binary.BigEndian, v)
+	case []float64:
+		b.WriteString("[$D#")
+		ubjWriteInt(b, int64(len(v)))
+		binary.Write(b, binary.BigEndian, v)
+	case []int32:
+		b.WriteString("[$l#")
+		ubjWriteInt(b, int64(len(v)))
+		binary.Write(b, binary.BigEndian, v)
+	case []uint8:
+		b.WriteString("[$U#")
+		ubjWriteInt(b, int64(len(v)))
+		b.Write(v)
+	case []int:
+		b.WriteString("[$L#")
+		ubjWriteInt(b, int64(len(v)))
+		for _, n := range v {
+			binary.Write(b, binary.BigEndian, int64(n))
+		}
+	case []any:
+		b.WriteByte('[')
+		for _, e := range v {
+			if err := ubjWrite(b, e); err != nil {
+				return err
+			}
+		}
+		b.WriteByte(']')
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b.WriteByte('{')
+		for _, k := range keys {
+			ubjWriteString(b, k)
+			if err := ubjWrite(b, v[k]); err != nil {
+				return err
+			}
+		}
+		b.WriteByte('}')
+	default:
+		return fmt.Errorf("Type %T can't be encoded as UBJSON", v)
+	}
+	return nil
+}
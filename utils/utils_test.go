@@ -1,8 +1,11 @@
 package utils
 
 import (
+	"bytes"
 	"fmt"
+	"math"
 	"slices"
+	"strings"
 	"testing"
 
 	"gonum.org/v1/gonum/mat"
@@ -53,6 +56,22 @@ func TestLibSVM(Te *testing.T) {
 
 }
 
+// The writer used to leave one empty field per feature between the label and the features.
+func TestLibSVMWriter(Te *testing.T) {
+	data := &DataBunch{Data: [][]float64{{1, 2}, {3, 4}}, Labels: []int{0, 1}}
+	lines := strings.Split(data.LibSVM(), "\n")
+	if len(lines) != 2 || lines[0] != "  0 1:1.0000 2:2.0000" {
+		Te.Errorf("Unexpected libSVM output: %q", lines)
+	}
+	r, err := ParseLibSVMFromReader(strings.NewReader(data.LibSVM()+"\n"), false)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if !slices.Equal(r.Data[1], data.Data[1]) || !slices.Equal(r.Labels, data.Labels) {
+		Te.Errorf("Data not recovered from the libSVM output: %v %v", r.Data, r.Labels)
+	}
+}
+
 func TestSampleSlice(Te *testing.T) {
 	test := []float64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
 	indx := []int{0, 3, 5, 9}
@@ -87,3 +106,185 @@ func TestArgSort(Te *testing.T) {
 	fmt.Println(i, f)
 
 }
+
+func TestQID(Te *testing.T) {
+	svm := "2 qid:1 1:0.5 2:1.0\n0 qid:1 1:0.1 2:0.2\n1 qid:2 1:0.3 2:0.3\n"
+	data, err := ParseLibSVMFromReader(strings.NewReader(svm), false)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	fmt.Println(data.LibSVM())
+	if !slices.Equal(data.Groups, []int{1, 1, 2}) || len(data.Data[0]) != 2 {
+		Te.Errorf("Wrong groups or data read: %v %v", data.Groups, data.Data)
+	}
+	if g := data.QueryGroups(); len(g) != 2 || !slices.Equal(g[0], []int{0, 1}) {
+		Te.Errorf("Wrong query groups %v", g)
+	}
+	//either all the lines have a query id, or none does.
+	if _, err := ParseLibSVMFromReader(strings.NewReader(svm+"0 1:0.2 2:0.1\n"), false); err == nil {
+		Te.Errorf("A line without a query id among lines with one should be an error")
+	}
+}
+
+func TestRankMetrics(Te *testing.T) {
+	rel := []float64{3, 2, 0, 1}
+	if n := NDCG(rel, []float64{4, 3, 1, 2}, 0); math.Abs(n-1) > 1e-12 {
+		Te.Errorf("NDCG of the ideal ranking is %v", n)
+	}
+	//DCG with the order 1,0,3,2 (relevances 2,3,1,0)
+	dcg := 3/math.Log2(2) + 7/math.Log2(3) + 1/math.Log2(4)
+	idcg := 7/math.Log2(2) + 3/math.Log2(3) + 1/math.Log2(4)
+	if n := NDCG(rel, []float64{3, 4, 1, 2}, 0); math.Abs(n-dcg/idcg) > 1e-12 {
+		Te.Errorf("NDCG is %v, expected %v", n, dcg/idcg)
+	}
+	//relevant at positions 2 and 3: (1/2+2/3)/2
+	if ap := AveragePrecision([]float64{0, 1, 1}, []float64{3, 2, 1}); math.Abs(ap-7.0/12) > 1e-12 {
+		Te.Errorf("AP is %v, expected %v", ap, 7.0/12)
+	}
+}
+
+func TestSurvivalGradients(Te *testing.T) {
+	D := &DataBunch{Data: make([][]float64, 6), Times: []float64{5, 2, 2, 8, 3, 9}, Censored: []bool{false, false, true, true, false, false}}
+	raw := []float64{0.1, -0.3, 0.5, 0.2, -0.1, 0.4}
+	grads := make([]float64, len(raw))
+	hess := make([]float64, len(raw))
+	const h = 1e-6
+	for _, obj := range []Objective{&CoxPH{}, &AFT{Sigma: 0.8}} {
+		scale := float64(len(raw)) //AFT's value is a mean over samples
+		if obj.Name() == "survival:cox" {
+			scale = 4 //Cox's value is a mean over the events
+		}
+		obj.GradHess(D, raw, grads, hess)
+		for i := range raw {
+			r := slices.Clone(raw)
+			r[i] += h
+			up := obj.Value(D, r) * scale
+			r[i] -= 2 * h
+			down := obj.Value(D, r) * scale
+			if num := (up - down) / (2 * h); math.Abs(num-grads[i]) > 1e-5 {
+				Te.Errorf("%s: numerical gradient %v analytical %v for sample %d", obj.Name(), num, grads[i], i)
+			}
+		}
+	}
+	//9 comparable pairs (an event and a later time), none ordered as raw, all as -time,
+	//and all tied with a constant risk.
+	for _, c := range []struct {
+		risk []float64
+		c    float64
+	}{{raw, 0}, {[]float64{-5, -2, -2, -8, -3, -9}, 1}, {make([]float64, 6), 0.5}} {
+		if ci := ConcordanceIndex(D, c.risk); math.Abs(ci-c.c) > 1e-12 {
+			Te.Errorf("C-index %v for risks %v, expected %v", ci, c.risk, c.c)
+		}
+	}
+}
+
+func TestDeviances(Te *testing.T) {
+	y := []float64{0, 1, 3, 2.5}
+	mu := []float64{1e-12, 1, 3, 2.5}
+	if d := PoissonDeviance(y, mu); math.Abs(d) > 1e-9 {
+		Te.Errorf("Poisson deviance of a perfect fit is %v", d)
+	}
+	if d := TweedieDeviance(y, mu, 1.5); math.Abs(d) > 1e-5 {
+		Te.Errorf("Tweedie deviance of a perfect fit is %v", d)
+	}
+	if d := GammaDeviance(y[1:], mu[1:]); math.Abs(d) > 1e-9 {
+		Te.Errorf("Gamma deviance of a perfect fit is %v", d)
+	}
+	//The Tweedie deviance tends to the Poisson one as the power goes to 1.
+	mu = []float64{0.5, 2, 2, 3}
+	if d, dp := TweedieDeviance(y, mu, 1.0001), PoissonDeviance(y, mu); math.Abs(d-dp) > 1e-3 {
+		Te.Errorf("Tweedie deviance with power ~1, %v, differs from the Poisson one, %v", d, dp)
+	}
+	for _, p := range []float64{0.5, 1, 2, 3} {
+		if _, err := NewTweedieObj(p); err == nil {
+			Te.Errorf("Tweedie power %v accepted", p)
+		}
+		if d := TweedieDeviance(y, mu, p); !math.IsNaN(d) {
+			Te.Errorf("Tweedie deviance with power %v is %v, expected NaN", p, d)
+		}
+	}
+	if _, err := NewTweedieObj(1.3); err != nil {
+		Te.Error(err)
+	}
+}
+
+func TestMultiLabelMetrics(Te *testing.T) {
+	actual := [][]int{{1, 2}, {3}, {}, {1}}
+	predicted := [][]int{{2, 1}, {1}, {}, {1, 3}}
+	labels := []int{1, 2, 3}
+	if h := HammingLoss(actual, predicted, labels); math.Abs(h-3.0/12) > 1e-12 {
+		Te.Errorf("Hamming loss %v", h)
+	}
+	if s := SubsetAccuracy(actual, predicted); s != 0.5 {
+		Te.Errorf("Subset accuracy %v", s)
+	}
+	//tp: 3, fp: 2, fn: 1
+	if f := MicroF1(actual, predicted, labels); math.Abs(f-6.0/9) > 1e-12 {
+		Te.Errorf("Micro F1 %v", f)
+	}
+	//label 1: tp 2, fp 1, label 2: tp 1, label 3: fp 1 fn 1
+	if f := MacroF1(actual, predicted, labels); math.Abs(f-(0.8+1+0)/3) > 1e-12 {
+		Te.Errorf("Macro F1 %v", f)
+	}
+}
+
+func TestCalibrationFits(Te *testing.T) {
+	x, y := isotonicFit([]float64{0.1, 0.2, 0.3, 0.4, 0.5}, []float64{0, 1, 0, 1, 1})
+	if !slices.Equal(y, []float64{0, 0.5, 1}) || math.Abs(x[1]-0.25) > 1e-12 {
+		Te.Errorf("Isotonic fit: %v %v", x, y)
+	}
+	if v := interpolate(x, y, 0.175); math.Abs(v-0.25) > 1e-12 {
+		Te.Errorf("Isotonic interpolation: %v", v)
+	}
+	//outcomes drawn with probability sigmoid(2*logit(p)-1), so A=-2, B=1
+	p := make([]float64, 0, 2000)
+	t := make([]float64, 0, 2000)
+	for i := 0; i < 2000; i++ {
+		pi := (float64(i) + 0.5) / 2000
+		p = append(p, pi)
+		t = append(t, 1/(1+math.Exp(-2*logit(pi)+1)))
+	}
+	//each probability is repeated 10 times, with a fraction of positive outcomes close to the
+	//expected one.
+	pp := make([]float64, 0, 20000)
+	tt := make([]float64, 0, 20000)
+	for i, v := range p {
+		n := int(math.Round(t[i] * 10))
+		for j := 0; j < 10; j++ {
+			pp = append(pp, v)
+			if j < n {
+				tt = append(tt, 1)
+			} else {
+				tt = append(tt, 0)
+			}
+		}
+	}
+	A, B := plattFit(pp, tt)
+	if math.Abs(A+2) > 0.2 || math.Abs(B-1) > 0.2 {
+		Te.Errorf("Platt fit: A=%.3f, B=%.3f, expected -2, 1", A, B)
+	}
+	if e := ECE([]float64{0.1, 0.9, 0.9}, []float64{0, 1, 0}, 10); math.Abs(e-(0.1+2*0.4)/3) > 1e-12 {
+		Te.Errorf("ECE: %v", e)
+	}
+}
+
+func TestUBJSON(Te *testing.T) {
+	v := map[string]any{"a": []float32{1.5, -2}, "b": "text", "c": []any{int64(300), true, nil, 2.25}, "d": map[string]any{"e": int64(-70000)}}
+	b, err := MarshalUBJSON(v)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	d, err := DecodeUBJSON(bytes.NewReader(b))
+	if err != nil {
+		Te.Fatal(err)
+	}
+	expected := map[string]any{"a": []any{1.5, -2.0}, "b": "text", "c": []any{int64(300), true, nil, 2.25}, "d": map[string]any{"e": int64(-70000)}}
+	if fmt.Sprint(d) != fmt.Sprint(expected) {
+		Te.Errorf("Decoded UBJSON %v, expected %v", d, expected)
+	}
+	//an object with a count, and a no-op
+	d, err = DecodeUBJSON(bytes.NewReader([]byte{'N', '{', '#', 'i', 1, 'i', 1, 'x', 'C', 'y'}))
+	if err != nil || fmt.Sprint(d) != fmt.Sprint(map[string]any{"x": "y"}) {
+		Te.Errorf("Decoded UBJSON %v, error: %v", d, err)
+	}
+}
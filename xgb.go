@@ -26,6 +26,78 @@ func NewMultiClass(D *utils.DataBunch, opts ...*Options) *MultiClass {
 		O = DefaultXOptions()
 	}
 	ohelabels, differentlabels := D.OHELabels()
+	ret, err := fitMultiOutput(D, O, ohelabels, differentlabels, "softmax")
+	if err != nil {
+		panic(err.Error())
+	}
+	return ret.setSchema(D, O)
+}
+
+// Like NewMultiClass, but the options are checked first, and errors, such as a custom objective
+// returning the wrong number of gradients, are returned instead of causing a panic.
+func FitMultiClass(D *utils.DataBunch, opts ...*Options) (*MultiClass, error) {
+	O := DefaultXOptions()
+	if len(opts) > 0 && opts[0] != nil {
+		O = opts[0]
+	}
+	if err := O.Check(); err != nil {
+		return nil, err
+	}
+	ohelabels, differentlabels := D.OHELabels()
+	ret, err := fitMultiOutput(D, O, ohelabels, differentlabels, "softmax")
+	if err != nil {
+		return nil, err
+	}
+	return ret.setSchema(D, O), nil
+}
+
+// Produces (and fits) a new multi-label classification boosted tree ensamble,
+// where each data vector can belong to several classes (labels) at the same time.
+// The labels for each data vector are taken from the LabelSets in D. One tree per label
+// is built in each round, and the outputs are passed through a sigmoid
+// function, so each is the independent probability of the sample having that label.
+// It will be of xgboost type if xgboost is true, regular gradient boosting othewise.
+func NewMultiLabel(D *utils.DataBunch, opts ...*Options) *MultiClass {
+	var O *Options
+	if len(opts) > 0 && opts[0] != nil {
+		O = opts[0]
+	} else {
+		O = DefaultXOptions()
+	}
+	mhlabels, differentlabels := D.MultiHotLabels()
+	ret, err := fitMultiOutput(D, O, mhlabels, differentlabels, "sigmoid")
+	if err != nil {
+		panic(err.Error())
+	}
+	return ret.setSchema(D, O)
+}
+
+// Like NewMultiLabel, but the options are checked first, and errors are returned
+// instead of causing a panic.
+func FitMultiLabel(D *utils.DataBunch, opts ...*Options) (*MultiClass, error) {
+	O := DefaultXOptions()
+	if len(opts) > 0 && opts[0] != nil {
+		O = opts[0]
+	}
+	if err := O.Check(); err != nil {
+		return nil, err
+	}
+	mhlabels, differentlabels := D.MultiHotLabels()
+	ret, err := fitMultiOutput(D, O, mhlabels, differentlabels, "sigmoid")
+	if err != nil {
+		return nil, err
+	}
+	return ret.setSchema(D, O), nil
+}
+
+// Fits an ensemble with one tree per output (column of the targets matrix) and round,
+// passing the raw predictions through the activation function with the given name
+// (a key of ProbTransformMap). Returns an error if the custom objective, if any, fails.
+func fitMultiOutput(D *utils.DataBunch, O *Options, ohelabels *mat.Dense, differentlabels []int, activation string) (*MultiClass, error) {
+	if O.MultiOutput {
+		return fitVectorLeaf(D, O, ohelabels, differentlabels, activation)
+	}
+	probTransform := ProbTransformMap[activation]
 	nlabels := len(differentlabels)
 	boosters := make([][]*Tree, 0, nlabels)
 	r, c := ohelabels.Dims()
@@ -38,7 +110,7 @@ func NewMultiClass(D *utils.DataBunch, opts ...*Options) *MultiClass {
 	}
 	tin := make([]int, len(D.Data))
 	tval := make([]float64, len(D.Data))
-	probs := utils.SoftMaxDense(rawPred, nil)
+	probs := probTransform(rawPred, nil)
 	grads := mat.NewDense(1, r, nil)
 	hess := mat.NewDense(1, r, nil)
 	tmpPreds := make([]float64, r)
@@ -46,19 +118,56 @@ func NewMultiClass(D *utils.DataBunch, opts ...*Options) *MultiClass {
 	stopped := make([]bool, len(differentlabels))
 	roundsNoProgress := make([]int, len(differentlabels))
 	prevloss := make([]float64, len(differentlabels))
-
+	var weights [][]float64 //only used for DART
+	var dropPreds [][]float64
+	var oobLosses, oobImprovements []float64
+	oobNoProgress := 0
+	var prevmetric float64
+	metricNoProgress := 0
 	for round := 0; round < O.Rounds; round++ {
-		var sampleIndexes, sampleCols []int
+		var sampleIndexes, sampleCols, oobIndexes []int
+		var oobprev float64
 		if O.SubSample < 1 && O.XGB {
 			sampleIndexes = SubSample(len(D.Data), O.SubSample)
+			if len(sampleIndexes) < O.MinSample {
+				continue
+			}
+			oobIndexes = outOfBag(sampleIndexes, len(D.Data))
+			oobprev = oobLoss(O.Loss, ohelabels, probs, oobIndexes)
 		}
 		if O.ColSubSample < 1 && O.XGB {
 			sampleCols = SubSample(len(D.Data[0]), O.ColSubSample)
 		}
-		if len(sampleIndexes) < O.MinSample {
-			continue
+		var dropped []int
+		if O.DART && len(boosters) > 0 {
+			dropped = dropRounds(len(boosters), O.DropRate, O.SkipDrop)
+		}
+		//With DART, the new trees of all classes are fitted to the predictions without
+		//the dropped trees (raw, dprobs), while rawPred and probs keep the whole ensemble.
+		raw, dprobs := rawPred, probs
+		if len(dropped) > 0 {
+			if dropPreds == nil {
+				dropPreds = make([][]float64, nlabels)
+			}
+			raw = mat.DenseCopyOf(rawPred)
+			for k := 0; k < nlabels; k++ {
+				dropPreds[k] = dartContribution(D.Data, boosters, weights, dropped, k, O.LearningRate, dropPreds[k])
+				floats.Scale(-1, dropPreds[k])
+				utils.AddToCol(raw, dropPreds[k], k)
+			}
+			dprobs = probTransform(raw, nil)
+		}
+		//The custom objective is called once per round, for all classes, with the
+		//predictions at the beginning of the round.
+		var cgrads, chess *mat.Dense
+		if O.Objective != nil {
+			var err error
+			if cgrads, chess, err = customGradHess(O.Objective, ohelabels, raw); err != nil {
+				return nil, err
+			}
 		}
 		classes := make([]*Tree, 0, 1)
+		cweights := make([]float64, 0, 1)
 		for k := 0; k < nlabels; k++ {
 			if stopped[k] {
 				continue
@@ -66,13 +175,19 @@ func NewMultiClass(D *utils.DataBunch, opts ...*Options) *MultiClass {
 			var tOpts *TreeOptions
 			var tree *Tree
 			kthlabelvector := utils.DenseCol(ohelabels, k)
-			kthprobs := utils.DenseCol(probs, k)
-			hess = O.Loss.Hessian(kthprobs, nil) //keep an eye on this.
+			kthprobs := utils.DenseCol(dprobs, k)
+			if O.Objective == nil {
+				hess = O.Loss.Hessian(kthprobs, nil) //keep an eye on this.
+			}
 			if O.XGB {
 				tOpts = DefaultXTreeOptions()
 				tOpts.MinChildWeight = O.MinChildWeight
 				tOpts.MaxDepth = O.MaxDepth
-				grads = O.Loss.Gradients(kthlabelvector, kthprobs, grads)
+				if O.Objective != nil {
+					grads, hess = utils.DenseCol(cgrads, k), utils.DenseCol(chess, k)
+				} else {
+					grads = O.Loss.Gradients(kthlabelvector, kthprobs, grads)
+				}
 				tOpts.Lambda = O.Lambda
 				tOpts.Gamma = O.Gamma
 				tOpts.Indexes = sampleIndexes
@@ -94,12 +209,32 @@ func NewMultiClass(D *utils.DataBunch, opts ...*Options) *MultiClass {
 				tOpts.Gradients = nil
 				tOpts.Hessian = nil
 				tree = NewTree(D.Data, tOpts)
-				updateLeaves(tree, grads, hess)
+				if lu, ok := O.Loss.(utils.LeafUpdater); ok {
+					updateLeavesResiduals(tree, kthlabelvector.RawRowView(0), kthprobs.RawRowView(0), lu)
+				} else {
+					updateLeaves(tree, grads, hess)
+				}
 			}
 			tmpPreds = tree.Predict(D.Data, tmpPreds)
-			floats.Scale(O.LearningRate, tmpPreds)
+			w := 1.0
+			if len(dropped) > 0 {
+				//Same normalization as xgboost's "tree" normalize_type: the new tree gets
+				//1/(k+lr) as weight, the dropped ones are scaled by k/(k+lr)
+				nd := float64(len(dropped))
+				w = 1 / (nd + O.LearningRate)
+				factor := nd / (nd + O.LearningRate)
+				for _, r := range dropped {
+					if k < len(weights[r]) {
+						weights[r][k] *= factor
+					}
+				}
+				//dropPreds[k] holds minus the dropped contribution, which now shrinks by factor.
+				floats.Scale(1-factor, dropPreds[k])
+				utils.AddToCol(rawPred, dropPreds[k], k)
+			}
+			floats.Scale(O.LearningRate*w, tmpPreds)
 			utils.AddToCol(rawPred, tmpPreds, k)
-			probs = utils.SoftMaxDense(rawPred, probs)
+			probs = probTransform(rawPred, probs)
 			var currloss float64
 			if O.EarlyStop > 0 || O.Verbose {
 				//    t:=mat.NewDense(1, len(tmpPreds), tmpPreds)
@@ -107,10 +242,11 @@ func NewMultiClass(D *utils.DataBunch, opts ...*Options) *MultiClass {
 				currloss = O.Loss.Loss(kthlabelvector, kthprobs, tmploss)
 			}
 			classes = append(classes, tree)
+			cweights = append(cweights, w)
 			if O.Verbose {
 				fmt.Printf("round: %d, class: %d train loss = %.3f\n", round, k, currloss)
 			}
-			if O.EarlyStop > 0 {
+			if O.EarlyStop > 0 && !O.OOBEarlyStop && O.Metric == nil {
 				epsilon := 1e-6
 				if currloss <= epsilon {
 					stopped[k] = true
@@ -137,11 +273,188 @@ func NewMultiClass(D *utils.DataBunch, opts ...*Options) *MultiClass {
 			}
 		}
 		boosters = append(boosters, classes)
+		weights = append(weights, cweights)
+		if O.Metric != nil {
+			currmetric := O.Metric(ohelabels.RawMatrix().Data, rawPred.RawMatrix().Data)
+			if O.Verbose {
+				fmt.Printf("round: %d, train metric = %.3f\n", round, currmetric)
+			}
+			if O.EarlyStop > 0 && !O.OOBEarlyStop {
+				if round > 0 && prevmetric <= currmetric {
+					metricNoProgress++
+				} else {
+					metricNoProgress = 0
+				}
+				if metricNoProgress >= O.EarlyStop {
+					if O.Verbose {
+						log.Println("Stopped early (metric) at round", round)
+					}
+					break
+				}
+				prevmetric = currmetric
+			}
+		}
+		if O.SubSample < 1 && O.XGB {
+			currloss := oobLoss(O.Loss, ohelabels, probs, oobIndexes)
+			oobLosses = append(oobLosses, currloss)
+			oobImprovements = append(oobImprovements, oobprev-currloss)
+			if O.Verbose {
+				fmt.Printf("round: %d, OOB loss = %.3f, OOB improvement = %.3f\n", round, currloss, oobprev-currloss)
+			}
+			if O.OOBEarlyStop && O.EarlyStop > 0 {
+				//NaN improvements (no out-of-bag samples) count as no progress
+				if !(oobprev-currloss > 0) {
+					oobNoProgress++
+				} else {
+					oobNoProgress = 0
+				}
+				if oobNoProgress >= O.EarlyStop {
+					if O.Verbose {
+						log.Println("Stopped early (out-of-bag) at round", round)
+					}
+					break
+				}
+			}
+		}
+	}
+	if !O.DART {
+		weights = nil
 	}
-	return &MultiClass{b: boosters, learningRate: O.LearningRate, probTransform: utils.SoftMaxDense, classLabels: differentlabels, baseScore: O.BaseScore, xgb: O.XGB}
+	return &MultiClass{b: boosters, learningRate: O.LearningRate, probTransform: probTransform, probTransformName: activation, classLabels: differentlabels, baseScore: O.BaseScore, xgb: O.XGB, weights: weights, oobLoss: oobLosses, oobImprovement: oobImprovements}, nil
 
 }
 
+// Fits an xgboost ensemble with a single vector-leaf tree per round, where each leaf contains
+// one value per output (column of the targets matrix), and each split is chosen by the gain summed over
+// all outputs. DART is not supported. Early stopping uses the total loss over all outputs.
+func fitVectorLeaf(D *utils.DataBunch, O *Options, ohelabels *mat.Dense, differentlabels []int, activation string) (*MultiClass, error) {
+	probTransform := ProbTransformMap[activation]
+	nlabels := len(differentlabels)
+	boosters := make([][]*Tree, 0, O.Rounds)
+	r, c := ohelabels.Dims()
+	rawPred := mat.NewDense(r, c, nil)
+	utils.ToOnes(rawPred)
+	rawPred.Scale(O.BaseScore, rawPred)
+	if O.MinChildWeight < 1 {
+		O.MinChildWeight = 1
+	}
+	tin := make([]int, r)
+	tval := make([]float64, r)
+	probs := probTransform(rawPred, nil)
+	grads := make([][]float64, nlabels)
+	hess := make([][]float64, nlabels)
+	tmpPreds := make([]float64, c)
+	var prevloss float64
+	roundsNoProgress := 0
+	var oobLosses, oobImprovements []float64
+	for round := 0; round < O.Rounds; round++ {
+		var sampleIndexes, sampleCols, oobIndexes []int
+		var oobprev float64
+		if O.SubSample < 1 {
+			sampleIndexes = SubSample(r, O.SubSample)
+			if len(sampleIndexes) < O.MinSample {
+				continue
+			}
+			oobIndexes = outOfBag(sampleIndexes, r)
+			oobprev = oobLoss(O.Loss, ohelabels, probs, oobIndexes)
+		}
+		if O.ColSubSample < 1 {
+			sampleCols = SubSample(len(D.Data[0]), O.ColSubSample)
+		}
+		var cgrads, chess *mat.Dense
+		if O.Objective != nil {
+			var err error
+			if cgrads, chess, err = customGradHess(O.Objective, ohelabels, rawPred); err != nil {
+				return nil, err
+			}
+		}
+		for k := 0; k < nlabels; k++ {
+			if O.Objective != nil {
+				grads[k], hess[k] = utils.DenseCol(cgrads, k).RawRowView(0), utils.DenseCol(chess, k).RawRowView(0)
+				continue
+			}
+			kthlabelvector := utils.DenseCol(ohelabels, k)
+			kthprobs := utils.DenseCol(probs, k)
+			grads[k] = O.Loss.Gradients(kthlabelvector, kthprobs, nil).RawRowView(0)
+			hess[k] = O.Loss.Hessian(kthprobs, nil).RawRowView(0)
+		}
+		tOpts := DefaultXTreeOptions()
+		tOpts.MinChildWeight = O.MinChildWeight
+		tOpts.MaxDepth = O.MaxDepth
+		tOpts.Lambda = O.Lambda
+		tOpts.Gamma = O.Gamma
+		tOpts.Indexes = sampleIndexes
+		tOpts.AllowedColumns = sampleCols
+		tOpts.MultiGradients = grads
+		tOpts.MultiHessian = hess
+		tOpts.in = tin
+		tOpts.val = tval
+		tree := NewTree(D.Data, tOpts)
+		for i, v := range D.Data {
+			for k := range tmpPreds {
+				tmpPreds[k] = 0
+			}
+			tree.addPredictSingleVector(v, O.LearningRate, tmpPreds)
+			row := rawPred.RawRowView(i)
+			floats.Add(row, tmpPreds)
+		}
+		probs = probTransform(rawPred, probs)
+		boosters = append(boosters, []*Tree{tree})
+		var currloss float64
+		if O.Metric != nil {
+			currloss = O.Metric(ohelabels.RawMatrix().Data, rawPred.RawMatrix().Data)
+		} else if O.EarlyStop > 0 || O.Verbose {
+			currloss = O.Loss.Loss(ohelabels, probs, nil)
+		}
+		if O.Verbose {
+			fmt.Printf("round: %d, train loss = %.3f\n", round, currloss)
+		}
+		if O.SubSample < 1 {
+			oobcurr := oobLoss(O.Loss, ohelabels, probs, oobIndexes)
+			oobLosses = append(oobLosses, oobcurr)
+			oobImprovements = append(oobImprovements, oobprev-oobcurr)
+			if O.Verbose {
+				fmt.Printf("round: %d, OOB loss = %.3f, OOB improvement = %.3f\n", round, oobcurr, oobprev-oobcurr)
+			}
+			if O.OOBEarlyStop {
+				//we use the same logic as below, but with the out-of-bag loss.
+				currloss = oobcurr
+			}
+		}
+		if O.EarlyStop > 0 {
+			if round == 0 {
+				prevloss = currloss
+				continue
+			}
+			if !(prevloss > currloss) {
+				roundsNoProgress++
+			} else {
+				roundsNoProgress = 0
+			}
+			if roundsNoProgress >= O.EarlyStop {
+				if O.Verbose {
+					log.Println("Stopped early at round", round)
+				}
+				break
+			}
+			prevloss = currloss
+		}
+	}
+	return &MultiClass{b: boosters, learningRate: O.LearningRate, probTransform: probTransform, probTransformName: activation, classLabels: differentlabels, baseScore: O.BaseScore, xgb: true, oobLoss: oobLosses, oobImprovement: oobImprovements}, nil
+}
+
+// Calls the custom objective f with the labels and raw predictions and returns the gradients and
+// Hessian, as nxk matrices. Returns an error if f doesn't return one gradient and one Hessian
+// element per raw prediction.
+func customGradHess(f utils.ObjectiveFunc, labels, raw *mat.Dense) (*mat.Dense, *mat.Dense, error) {
+	r, c := raw.Dims()
+	g, h := f(labels.RawMatrix().Data, raw.RawMatrix().Data)
+	if len(g) != r*c || len(h) != r*c {
+		return nil, nil, fmt.Errorf("Custom objective returned %d gradients and %d hessian elements, expected %d", len(g), len(h), r*c)
+	}
+	return mat.NewDense(r, c, g), mat.NewDense(r, c, h), nil
+}
+
 // Obtains the Log of the odds for a nxm matrix
 // where each element i,j is the probability of the
 // samble i to belong to class j.
@@ -195,6 +508,74 @@ func SubSample(totdata int, subsample float64) []int {
 	return ret
 }
 
+// Returns the indexes, out of total, that are not in the sorted slice sample.
+func outOfBag(sample []int, total int) []int {
+	ret := make([]int, 0, total-len(sample))
+	j := 0
+	for i := 0; i < total; i++ {
+		if j < len(sample) && sample[j] == i {
+			j++
+			continue
+		}
+		ret = append(ret, i)
+	}
+	return ret
+}
+
+// Returns the loss for the rows with the given indexes of the one-hot-encoded labels
+// and the probabilities. Returns NaN if no indexes are given.
+func oobLoss(loss utils.LossFunc, ohelabels, probs *mat.Dense, indexes []int) float64 {
+	if len(indexes) == 0 {
+		return math.NaN()
+	}
+	_, c := ohelabels.Dims()
+	y := mat.NewDense(len(indexes), c, nil)
+	p := mat.NewDense(len(indexes), c, nil)
+	for i, v := range indexes {
+		y.SetRow(i, ohelabels.RawRowView(v))
+		p.SetRow(i, probs.RawRowView(v))
+	}
+	return loss.Loss(y, p, nil)
+}
+
+// Returns the indexes of the rounds, out of the total given, that will be dropped
+// in a DART round. Each round is dropped with a probability rate, unless the whole
+// dropout is skipped, which happens with a probability skip.
+func dropRounds(rounds int, rate, skip float64) []int {
+	if rand.Float64() < skip {
+		return nil
+	}
+	ret := make([]int, 0, int(float64(rounds)*rate)+1)
+	for i := 0; i < rounds; i++ {
+		if rate > rand.Float64() {
+			ret = append(ret, i)
+		}
+	}
+	return ret
+}
+
+// Puts in ret (which is allocated if nil) the contribution of the trees for the given
+// class in the dropped rounds to the raw predictions for each vector in X.
+func dartContribution(X [][]float64, b [][]*Tree, weights [][]float64, dropped []int, class int, learningRate float64, ret []float64) []float64 {
+	if ret == nil {
+		ret = make([]float64, len(X))
+	}
+	for i := range ret {
+		ret[i] = 0
+	}
+	for _, r := range dropped {
+		if class >= len(b[r]) {
+			continue
+		}
+		tree := b[r][class]
+		f := learningRate * weights[r][class]
+		for i, v := range X {
+			ret[i] += f * tree.PredictSingle(v)
+		}
+	}
+	return ret
+}
+
 func updateLeaves(tree *Tree, gradient, hessian *mat.Dense) {
 	fn := func(leaf *Tree) {
 		if leaf.samples == nil {
@@ -205,12 +586,34 @@ func updateLeaves(tree *Tree, gradient, hessian *mat.Dense) {
 			sumhess += hessian.At(0, w)
 			sumgrad += gradient.At(0, w)
 		}
+		//samples can have a zero Hessian (for instance, in ranking, those without pairs).
+		if sumhess <= 1e-12 {
+			leaf.value = 0
+			return
+		}
 		nval := sumgrad / sumhess
 		leaf.value = nval
 	}
 	applyToLeafs(tree, fn)
 }
 
+// Sets the value of each leaf of the tree to the one given by lu for the
+// residuals (y-pred) of the samples in the leaf.
+func updateLeavesResiduals(tree *Tree, y, pred []float64, lu utils.LeafUpdater) {
+	res := make([]float64, 0, tree.nsamples)
+	fn := func(leaf *Tree) {
+		if leaf.samples == nil {
+			panic("Samples in one leaf are nil!")
+		}
+		res = res[:0]
+		for _, w := range leaf.samples {
+			res = append(res, y[w]-pred[w])
+		}
+		leaf.value = lu.LeafValue(res)
+	}
+	applyToLeafs(tree, fn)
+}
+
 func applyToLeafs(tree *Tree, fn func(*Tree)) {
 
 	if tree.left != nil {
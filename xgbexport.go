@@ -0,0 +1,223 @@
+package boo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/rmera/boo/utils"
+)
+
+// Writes the ensemble M as a model in XGBoost's JSON format, which can be loaded with
+// XGBoost's load_model. Multi-class (softmax) ensembles are written with the multi:softprob
+// objective, and multi-label (sigmoid) ones as multi-target models with the binary:logistic
+// objective. The learning rate and tree weights (for DART) are applied to the leaf values.
+// The number of features can be given, otherwise, the one of the training data is used if
+// known, or it is obtained from the features used in the trees. Random forests, vector-leaf and calibrated ensembles can't be exported.
+// Note that XGBoost compares the features and thresholds in single precision, so samples
+// with features very close to a threshold might be split differently than in boo.
+func WriteXGBoostJSON(M *MultiClass, w io.Writer, nfeatures ...int) error {
+	doc, err := xgbDocument(M, false, nfeatures...)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(doc)
+}
+
+// Same as WriteXGBoostJSON, but writes the model in XGBoost's universal binary JSON format
+// (the one used for files with the .ubj extension).
+func WriteXGBoostUBJ(M *MultiClass, w io.Writer, nfeatures ...int) error {
+	doc, err := xgbDocument(M, true, nfeatures...)
+	if err != nil {
+		return err
+	}
+	b, err := utils.MarshalUBJSON(doc)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// Returns the XGBoost model for M, as a map that can be marshaled to JSON
+// or to UBJSON. If typed is true, the arrays have the types used by XGBoost
+// in UBJSON files.
+func xgbDocument(M *MultiClass, typed bool, nfeatures ...int) (map[string]any, error) {
+	if M.calibration != nil {
+		return nil, fmt.Errorf("Calibrated ensembles can't be exported to XGBoost")
+	}
+	nclass := len(M.classLabels)
+	objective := map[string]any{}
+	base := M.BaseScores()
+	numClass, numTarget := nclass, 1
+	switch M.probTransformName {
+	case "softmax":
+		objective["name"] = "multi:softprob"
+		objective["softmax_multiclass_param"] = map[string]any{"num_class": strconv.Itoa(nclass)}
+	case "sigmoid":
+		objective["name"] = "binary:logistic"
+		objective["reg_loss_param"] = map[string]any{"scale_pos_weight": "1"}
+		for i, v := range base {
+			base[i] = 1 / (1 + math.Exp(-v)) //XGBoost stores it as a probability
+		}
+		numClass, numTarget = 0, nclass
+	default:
+		return nil, fmt.Errorf("Ensembles with activation %q can't be exported to XGBoost", M.probTransformName)
+	}
+	maxfeat := 0
+	trees := make([]any, 0, len(M.b)*nclass)
+	treeInfo := make([]int, 0, len(M.b)*nclass)
+	indptr := []int{0}
+	for round, ensemble := range M.b {
+		for class, tree := range ensemble {
+			if tree.VectorLeaf() {
+				return nil, fmt.Errorf("Vector-leaf ensembles can't be exported to XGBoost")
+			}
+			jt, mf := xgbTreeDocument(tree, M.learningRate*M.treeWeight(round, class), len(trees), typed)
+			maxfeat = max(maxfeat, mf+1)
+			trees = append(trees, jt)
+			treeInfo = append(treeInfo, class)
+		}
+		indptr = append(indptr, len(trees))
+	}
+	if len(nfeatures) > 0 && nfeatures[0] > 0 {
+		maxfeat = nfeatures[0]
+	} else if M.nfeatures > 0 {
+		maxfeat = M.nfeatures
+	}
+	names, types := []any{}, []any{}
+	if len(M.keys) == maxfeat {
+		for _, k := range M.keys {
+			names = append(names, k)
+			types = append(types, "float")
+		}
+	}
+	nf := strconv.Itoa(maxfeat)
+	for _, t := range trees {
+		t.(map[string]any)["tree_param"].(map[string]any)["num_feature"] = nf
+	}
+	model := map[string]any{
+		"gbtree_model_param": map[string]any{"num_parallel_tree": "1", "num_trees": strconv.Itoa(len(trees))},
+		"iteration_indptr":   indptr,
+		"tree_info":          treeInfo,
+		"trees":              trees,
+	}
+	learner := map[string]any{
+		"attributes":       map[string]any{},
+		"feature_names":    names,
+		"feature_types":    types,
+		"gradient_booster": map[string]any{"model": model, "name": "gbtree"},
+		"learner_model_param": map[string]any{
+			"base_score":         xgbBaseScoreString(base),
+			"boost_from_average": "1",
+			"num_class":          strconv.Itoa(numClass),
+			"num_feature":        nf,
+			"num_target":         strconv.Itoa(numTarget),
+		},
+		"objective": objective,
+	}
+	if typed {
+		//UBJSON needs typed arrays
+		model["iteration_indptr"] = toInt32s(indptr)
+		model["tree_info"] = toInt32s(treeInfo)
+	}
+	return map[string]any{"learner": learner, "version": []int{2, 0, 3}}, nil
+}
+
+// Returns the base score in XGBoost's format: a single number if it is the same for all outputs,
+// or, otherwise, a vector, as written by XGBoost 3, which older versions can't read.
+func xgbBaseScoreString(base []float64) string {
+	f := func(v float64) string { return strconv.FormatFloat(v, 'E', -1, 32) }
+	for _, v := range base {
+		if v != base[0] {
+			s := make([]string, len(base))
+			for i, v := range base {
+				s[i] = f(v)
+			}
+			return "[" + strings.Join(s, ",") + "]"
+		}
+	}
+	return f(base[0])
+}
+
+func toInt32s(s []int) []int32 {
+	ret := make([]int32, len(s))
+	for i, v := range s {
+		ret[i] = int32(v)
+	}
+	return ret
+}
+
+// Returns the XGBoost version of the tree, where the leaf values are multiplied
+// by the given factor, and the largest feature index used in the tree.
+func xgbTreeDocument(T *Tree, factor float64, id int, typed bool) (map[string]any, int) {
+	C := T.Compile()
+	n := len(C.Feature)
+	left := make([]int32, n)
+	right := make([]int32, n)
+	parents := make([]int32, n)
+	indices := make([]int32, n)
+	conditions := make([]float32, n)
+	weights := make([]float32, n)
+	gains := make([]float32, n)
+	hess := make([]float32, n)
+	flags := make([]uint8, n) //for default_left and split_type, all zeros
+	parents[0] = math.MaxInt32
+	maxfeat := 0
+	var walk func(t *Tree, i int)
+	walk = func(t *Tree, i int) {
+		hess[i] = float32(t.nsamples)
+		weights[i] = float32(t.value * factor)
+		if t.Leaf() {
+			left[i], right[i] = -1, -1
+			conditions[i] = weights[i] //XGBoost stores the leaf values there
+			return
+		}
+		left[i], right[i] = int32(C.Left[i]), int32(C.Right[i])
+		parents[C.Left[i]], parents[C.Right[i]] = int32(i), int32(i)
+		indices[i] = int32(t.splitFeatureIndex)
+		maxfeat = max(maxfeat, t.splitFeatureIndex)
+		//the smallest float32 above the threshold, as XGBoost uses x < condition
+		c := float32(t.threshold)
+		if float64(c) <= t.threshold {
+			c = math.Nextafter32(c, float32(math.Inf(1)))
+		}
+		conditions[i] = c
+		gains[i] = float32(t.bestScoreSoFar)
+		if !t.xgb {
+			gains[i] = -gains[i] //regular gradient boosting minimizes its criterion
+		}
+		walk(t.left, C.Left[i])
+		walk(t.right, C.Right[i])
+	}
+	walk(T, 0)
+	ret := map[string]any{
+		"base_weights":        weights,
+		"categories":          []any{},
+		"categories_nodes":    []any{},
+		"categories_segments": []any{},
+		"categories_sizes":    []any{},
+		"id":                  id,
+		"left_children":       left,
+		"loss_changes":        gains,
+		"parents":             parents,
+		"right_children":      right,
+		"split_conditions":    conditions,
+		"split_indices":       indices,
+		"sum_hessian":         hess,
+		"tree_param":          map[string]any{"num_deleted": "0", "num_nodes": strconv.Itoa(n), "size_leaf_vector": "1"},
+	}
+	if typed {
+		ret["default_left"] = flags
+		ret["split_type"] = flags
+	} else {
+		//a []uint8 would be marshaled to JSON as a string
+		ints := make([]int, n)
+		ret["default_left"] = ints
+		ret["split_type"] = ints
+	}
+	return ret, maxfeat
+}
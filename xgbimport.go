@@ -0,0 +1,318 @@
+package boo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rmera/boo/utils"
+)
+
+// A number in an XGBoost model file, which can be stored
+// either as a JSON number or as a string.
+type xgbNumber float64
+
+func (x *xgbNumber) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "" {
+		*x = 0
+		return nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	*x = xgbNumber(v)
+	return nil
+}
+
+// The base score, which can be a number or, in recent XGBoost versions,
+// a string with a vector (one value per output).
+type xgbBaseScore []float64
+
+func (x *xgbBaseScore) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(strings.Trim(string(b), `"`), "[]")
+	*x = (*x)[:0]
+	for _, f := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return fmt.Errorf("Invalid base score %s: %v", b, err)
+		}
+		*x = append(*x, v)
+	}
+	return nil
+}
+
+type xgbTree struct {
+	LeftChildren    []int       `json:"left_children"`
+	RightChildren   []int       `json:"right_children"`
+	SplitIndices    []int       `json:"split_indices"`
+	SplitConditions []float64   `json:"split_conditions"`
+	BaseWeights     []float64   `json:"base_weights"`
+	LossChanges     []float64   `json:"loss_changes"`
+	SumHessian      []float64   `json:"sum_hessian"`
+	DefaultLeft     []int       `json:"default_left"`
+	TreeParam       xgbTreeParm `json:"tree_param"`
+}
+
+type xgbTreeParm struct {
+	NumNodes       xgbNumber `json:"num_nodes"`
+	NumFeature     xgbNumber `json:"num_feature"`
+	SizeLeafVector xgbNumber `json:"size_leaf_vector"`
+}
+
+type xgbGBTree struct {
+	Model struct {
+		TreeInfo []int     `json:"tree_info"`
+		Trees    []xgbTree `json:"trees"`
+	} `json:"model"`
+}
+
+type xgbJSONModel struct {
+	Learner struct {
+		FeatureNames      []string `json:"feature_names"`
+		LearnerModelParam struct {
+			BaseScore  xgbBaseScore `json:"base_score"`
+			NumClass   xgbNumber    `json:"num_class"`
+			NumFeature xgbNumber    `json:"num_feature"`
+		} `json:"learner_model_param"`
+		Objective struct {
+			Name string `json:"name"`
+		} `json:"objective"`
+		GradientBooster struct {
+			Name string `json:"name"`
+			xgbGBTree
+			GBTree     *xgbGBTree `json:"gbtree"` //for dart boosters
+			WeightDrop []float64  `json:"weight_drop"`
+		} `json:"gradient_booster"`
+	} `json:"learner"`
+}
+
+// Reads a model in XGBoost's JSON format (written by XGBoost's save_model with a .json
+// extension) and returns it as a MultiClass. Only tree boosters ("gbtree" or "dart") with
+// the multi:softprob, multi:softmax, binary:logistic and binary:logitraw objectives are supported.
+// Binary models are converted into 2-class ones, where the probability of the class 1 is the
+// one given by XGBoost.
+// XGBoost sends samples with feature < split condition to the left, and compares the
+// features in single (float32) precision. The thresholds are adjusted so the same happens
+// in boo. Missing values (NaN) are not supported.
+func ReadXGBoostJSON(r io.Reader) (*MultiClass, error) {
+	j := new(xgbJSONModel)
+	if err := json.NewDecoder(r).Decode(j); err != nil {
+		return nil, fmt.Errorf("Error decoding XGBoost JSON model: %v", err)
+	}
+	return xgbModelToMultiClass(j)
+}
+
+// Same as ReadXGBoostJSON, but for models in XGBoost's universal binary JSON format
+// (written by XGBoost's save_model with a .ubj extension).
+func ReadXGBoostUBJ(r io.Reader) (*MultiClass, error) {
+	v, err := utils.DecodeUBJSON(r)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding XGBoost UBJ model: %v", err)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return ReadXGBoostJSON(bytes.NewReader(b))
+}
+
+// Reads an XGBoost model from the file with the given name. The format
+// is determined from the extension (.ubj for the binary format, JSON otherwise).
+func ReadXGBoostModel(filename string) (*MultiClass, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if strings.HasSuffix(strings.ToLower(filename), ".ubj") {
+		return ReadXGBoostUBJ(f)
+	}
+	return ReadXGBoostJSON(f)
+}
+
+func xgbModelToMultiClass(j *xgbJSONModel) (*MultiClass, error) {
+	l := j.Learner
+	gb := &l.GradientBooster.xgbGBTree
+	var weightDrop []float64
+	switch l.GradientBooster.Name {
+	case "gbtree":
+	case "dart":
+		if l.GradientBooster.GBTree == nil {
+			return nil, fmt.Errorf("DART XGBoost model without trees")
+		}
+		gb = l.GradientBooster.GBTree
+		weightDrop = l.GradientBooster.WeightDrop
+	default:
+		return nil, fmt.Errorf("Unsupported XGBoost booster: %s", l.GradientBooster.Name)
+	}
+	trees := gb.Model.Trees
+	if len(trees) == 0 {
+		return nil, fmt.Errorf("XGBoost model without trees")
+	}
+	if len(gb.Model.TreeInfo) != len(trees) {
+		return nil, fmt.Errorf("XGBoost model with %d trees but %d tree_info elements", len(trees), len(gb.Model.TreeInfo))
+	}
+	base := []float64(l.LearnerModelParam.BaseScore)
+	if len(base) == 0 {
+		base = []float64{0.5}
+	}
+	var nclass int
+	binary := false
+	switch obj := l.Objective.Name; obj {
+	case "multi:softprob", "multi:softmax":
+		nclass = int(l.LearnerModelParam.NumClass)
+	case "binary:logistic":
+		binary = true
+		nclass = 2
+		//the base score is a probability.
+		for i, v := range base {
+			base[i] = math.Log(v / (1 - v))
+		}
+	case "binary:logitraw":
+		binary = true
+		nclass = 2
+	default:
+		return nil, fmt.Errorf("Unsupported XGBoost objective: %s", obj)
+	}
+	//the margin added to each output
+	margins := make([]float64, nclass)
+	for k := range margins {
+		if binary {
+			margins[k] = base[0]
+		} else {
+			margins[k] = base[min(k, len(base)-1)]
+		}
+	}
+	//b[round][class]. The trees for each class are put in consecutive rounds.
+	var b [][]*Tree
+	var weights [][]float64
+	count := make([]int, nclass)
+	for t, jt := range trees {
+		class := gb.Model.TreeInfo[t]
+		if binary {
+			class = 1
+		}
+		if class < 0 || class >= nclass {
+			return nil, fmt.Errorf("Tree %d belongs to the class %d, but the model has %d classes", t, class, nclass)
+		}
+		if jt.TreeParam.SizeLeafVector > 1 {
+			return nil, fmt.Errorf("XGBoost vector-leaf trees are not supported")
+		}
+		tree, err := xgbTreeToTree(&jt)
+		if err != nil {
+			return nil, fmt.Errorf("Error in tree %d: %v", t, err)
+		}
+		round := count[class]
+		count[class]++
+		for len(b) <= round {
+			b = append(b, make([]*Tree, nclass))
+			weights = append(weights, make([]float64, nclass))
+		}
+		b[round][class] = tree
+		weights[round][class] = 1
+		if weightDrop != nil {
+			weights[round][class] = weightDrop[t]
+		}
+	}
+	if binary {
+		//the trees for the class 0 are all zero.
+		for _, round := range b {
+			round[0] = constantTree(0)
+		}
+		margins[0] = 0
+	}
+	for _, round := range b {
+		for _, tree := range round {
+			if tree == nil {
+				return nil, fmt.Errorf("The classes in the model don't have the same number of trees")
+			}
+		}
+	}
+	if weightDrop == nil {
+		weights = nil
+	}
+	labels := make([]int, nclass)
+	for i := range labels {
+		labels[i] = i
+	}
+	ret := &MultiClass{b: b, learningRate: 1, probTransform: utils.SoftMaxDense, probTransformName: "softmax", classLabels: labels, xgb: true, weights: weights}
+	ret.setBaseScores(margins)
+	ret.nfeatures = int(l.LearnerModelParam.NumFeature)
+	if len(l.FeatureNames) == ret.nfeatures {
+		ret.keys = l.FeatureNames
+	}
+	return ret, nil
+}
+
+// Returns a single-leaf xgboost tree with the given value.
+func constantTree(value float64) *Tree {
+	return &Tree{xgb: true, value: value, branches: 1}
+}
+
+// Converts an XGBoost tree into a boo Tree, starting from the root.
+func xgbTreeToTree(jt *xgbTree) (*Tree, error) {
+	n := len(jt.LeftChildren)
+	if n == 0 || len(jt.RightChildren) != n || len(jt.SplitIndices) != n || len(jt.SplitConditions) != n {
+		return nil, fmt.Errorf("Inconsistent XGBoost tree arrays")
+	}
+	var build func(i, depth int) (*Tree, error)
+	build = func(i, depth int) (*Tree, error) {
+		if i < 0 || i >= n || depth > n {
+			return nil, fmt.Errorf("Invalid node %d", i)
+		}
+		ret := &Tree{xgb: true, branches: 1}
+		if len(jt.SumHessian) == n {
+			ret.nsamples = int(jt.SumHessian[i])
+		}
+		if jt.LeftChildren[i] < 0 {
+			ret.value = jt.SplitConditions[i] //XGBoost stores the leaf values there
+			return ret, nil
+		}
+		if len(jt.BaseWeights) == n {
+			ret.value = jt.BaseWeights[i]
+		}
+		ret.splitFeatureIndex = jt.SplitIndices[i]
+		ret.threshold = xgbThreshold(jt.SplitConditions[i])
+		ret.bestScoreSoFar = math.SmallestNonzeroFloat64 //any non-zero value marks the node as a split
+		if len(jt.LossChanges) == n && jt.LossChanges[i] != 0 {
+			ret.bestScoreSoFar = jt.LossChanges[i]
+		}
+		var err error
+		if ret.left, err = build(jt.LeftChildren[i], depth+1); err != nil {
+			return nil, err
+		}
+		if ret.right, err = build(jt.RightChildren[i], depth+1); err != nil {
+			return nil, err
+		}
+		ret.branches += ret.left.branches + ret.right.branches
+		return ret, nil
+	}
+	return build(0, 0)
+}
+
+// Returns the largest threshold t such that, for any x, x <= t if and only if
+// float32(x) < float32(c), so boo's splits (x <= t) reproduce XGBoost's.
+func xgbThreshold(c float64) float64 {
+	c32 := float32(c)
+	if math.IsInf(float64(c32), 0) || math.IsNaN(float64(c32)) {
+		return math.Nextafter(c, math.Inf(-1))
+	}
+	prev := math.Nextafter32(c32, float32(math.Inf(-1)))
+	if math.IsInf(float64(prev), -1) {
+		return -math.MaxFloat64
+	}
+	//x rounds to c32 or above if it is above the midpoint between prev and c32.
+	//At the midpoint, it rounds to the value with an even mantissa.
+	mid := (float64(prev) + float64(c32)) / 2
+	if float32(mid) == prev {
+		return mid
+	}
+	return math.Nextafter(mid, math.Inf(-1))
+}
@@ -31,7 +31,9 @@ func (j *jsonTester) WriteString(w string) (int, error) {
 }
 
 var ProbTransformMap map[string]func(*mat.Dense, *mat.Dense) *mat.Dense = map[string]func(*mat.Dense, *mat.Dense) *mat.Dense{
-	"softmax": utils.SoftMaxDense,
+	"softmax":       utils.SoftMaxDense,
+	"normalization": utils.NormalizationDense,
+	"sigmoid":       utils.SigmoidDense,
 }
 
 func UnJSONMultiClass(r *bufio.Reader) (*MultiClass, error) {
@@ -48,7 +50,17 @@ func UnJSONMultiClass(r *bufio.Reader) (*MultiClass, error) {
 	ret.learningRate = jmc.LearningRate
 	ret.classLabels = jmc.ClassLabels
 	ret.probTransform = ProbTransformMap[jmc.ProbTransformName]
+	ret.probTransformName = jmc.ProbTransformName
 	ret.baseScore = jmc.BaseScore
+	if jmc.BaseScores != nil && len(jmc.BaseScores) != len(jmc.ClassLabels) {
+		return nil, fmt.Errorf("%d base scores for %d classes", len(jmc.BaseScores), len(jmc.ClassLabels))
+	}
+	ret.baseScores = jmc.BaseScores
+	ret.weights = jmc.TreeWeights
+	ret.calibration = jmc.Calibration
+	ret.options = jmc.Options
+	ret.keys = jmc.FeatureNames
+	ret.nfeatures = jmc.NFeatures
 	//I'm not sure this will work!
 	//	s, err = r.ReadString('\n')
 	//	if err != nil {
@@ -81,7 +93,9 @@ func UnJSONMultiClass(r *bufio.Reader) (*MultiClass, error) {
 		if err != nil {
 			return nil, fmt.Errorf("Error reading tree %d round %d, class %d: %v", cont, nround, nclass, err)
 		}
-		class = append(class, jtree.(*Tree))
+		tree := jtree.(*Tree)
+		tree.setOutputs()
+		class = append(class, tree)
 		nclass++
 		cont++
 	}
@@ -89,6 +103,9 @@ func UnJSONMultiClass(r *bufio.Reader) (*MultiClass, error) {
 		return nil, fmt.Errorf("Error reading of trees lines from file: %v", err)
 
 	}
+	if class != nil {
+		trees = append(trees, class) //the last round
+	}
 	ret.b = trees
 	return ret, nil
 }
@@ -133,6 +150,13 @@ type JSONMetaData struct {
 	ClassLabels       []int
 	ProbTransformName string
 	BaseScore         float64
+	BaseScores        []float64          `json:",omitempty"` //per-class base scores, only for some imported models
+	TreeWeights       [][]float64        `json:",omitempty"` //only for DART ensembles
+	Calibration       *utils.Calibration `json:",omitempty"`
+	Options           *Options           `json:",omitempty"` //the options used for training
+	Loss              string             `json:",omitempty"` //the name of the training loss
+	FeatureNames      []string           `json:",omitempty"` //the Keys of the training data
+	NFeatures         int                `json:",omitempty"` //the number of features of the training data
 }
 
 func MarshalMCMetaData(m *MultiClass, probtransformname string) ([]byte, error) {
@@ -141,6 +165,15 @@ func MarshalMCMetaData(m *MultiClass, probtransformname string) ([]byte, error)
 		ClassLabels:       m.classLabels,
 		ProbTransformName: probtransformname,
 		BaseScore:         m.baseScore,
+		BaseScores:        m.baseScores,
+		TreeWeights:       m.weights,
+		Calibration:       m.calibration,
+		Options:           m.options,
+		FeatureNames:      m.keys,
+		NFeatures:         m.nfeatures,
+	}
+	if m.options != nil {
+		r.Loss = m.options.LossName()
 	}
 	j, err := json.Marshal(r)
 	if err != nil {
@@ -165,6 +198,7 @@ func (t *Tree) JNode(id uint, addsamples ...bool) *utils.JSONNode {
 		BestScoreSoFar:    bs,
 		SplitFeatureIndex: t.splitFeatureIndex,
 		Value:             t.value,
+		Values:            t.values,
 		Leftid:            0,
 		Rightid:           0,
 	}
@@ -199,6 +233,7 @@ func creator(j *utils.JSONNode) utils.JTree {
 	ret := &Tree{
 		bestScoreSoFar:    j.BestScoreSoFar,
 		value:             j.Value,
+		values:            j.Values,
 		samples:           j.Samples,
 		nsamples:          j.Nsamples,
 		splitFeatureIndex: j.SplitFeatureIndex,